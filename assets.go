@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"golang.org/x/net/html"
+)
+
+// asset is an image or stylesheet referenced by Fullpage content. In
+// "upload" mode it is sent to the asset table and the page refers to it by
+// opts.AssetPrefix + ID, so the app can serve it offline.
+type asset struct {
+	ID          string `json:"id"`
+	ContentType string `json:"contentType"`
+	// Data is the file content, base64 encoded.
+	Data string `json:"data"`
+}
+
+var cssURL = regexp.MustCompile(`url\(\s*(['"]?)([^'")]+)(['"]?)\s*\)`)
+
+// assetBundler resolves the local files referenced by one page.
+type assetBundler struct {
+	opts     fullpageOptions
+	assets   []asset
+	seen     map[string]bool
+	warnings []string
+}
+
+// bundleAssets resolves the local images and stylesheets referenced by
+// fp.Content, relative to dir, and either inlines them as data URIs or
+// returns them as assets to upload, rewriting the references to match.
+func bundleAssets(fp *hb.Fullpage, dir string, opts fullpageOptions) (assets []asset, warnings []string, err error) {
+	switch opts.Assets {
+	case "", "off":
+		return
+	case "inline", "upload":
+	default:
+		err = fmt.Errorf("Not a valid assets mode: %v", opts.Assets)
+		return
+	}
+
+	doc, err := html.Parse(strings.NewReader(fp.Content))
+	if err != nil {
+		return
+	}
+
+	b := &assetBundler{opts: opts, seen: map[string]bool{}}
+	changed := false
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Namespace == "" {
+			switch {
+			case n.Data == "img":
+				if ref, ok := b.resolve(htmlpage.Attr(n, "src"), dir); ok {
+					setAttr(n, "src", ref)
+					changed = true
+				}
+			case n.Data == "link" && hasToken(htmlpage.Attr(n, "rel"), "stylesheet"):
+				if b.inlineStylesheet(n, dir) {
+					changed = true
+				}
+			case n.Data == "style" && n.FirstChild != nil && n.FirstChild.Type == html.TextNode:
+				css := b.rewriteCSS(n.FirstChild.Data, dir)
+				if css != n.FirstChild.Data {
+					n.FirstChild.Data = css
+					changed = true
+				}
+			}
+			for i, a := range n.Attr {
+				if a.Key == "style" && a.Namespace == "" {
+					css := b.rewriteCSS(a.Val, dir)
+					if css != a.Val {
+						n.Attr[i].Val = css
+						changed = true
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			walk(c)
+			c = next
+		}
+	}
+	walk(doc)
+
+	if changed {
+		var buf bytes.Buffer
+		err = html.Render(&buf, doc)
+		if err != nil {
+			return
+		}
+		fp.Content = buf.String()
+	}
+	return b.assets, b.warnings, nil
+}
+
+// inlineStylesheet handles a <link rel="stylesheet">. In "inline" mode the
+// link is replaced by a <style> element holding the CSS; in "upload" mode the
+// stylesheet is uploaded and the href rewritten.
+func (b *assetBundler) inlineStylesheet(n *html.Node, dir string) bool {
+	href := htmlpage.Attr(n, "href")
+	filename, ok := b.localFile(href, dir)
+	if !ok {
+		return false
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		b.warnings = append(b.warnings, fmt.Sprintf("assets: cannot read %v: %v", href, err))
+		return false
+	}
+	css := b.rewriteCSS(string(data), filepath.Dir(filename))
+
+	if b.opts.Assets == "upload" {
+		setAttr(n, "href", b.add(filename, []byte(css), "text/css"))
+		return true
+	}
+
+	if b.opts.InlineMax > 0 && int64(len(css)) > b.opts.InlineMax {
+		b.warnings = append(b.warnings, fmt.Sprintf("assets: %v is %v bytes, over the %v byte inline limit", href, len(css), b.opts.InlineMax))
+		return false
+	}
+	style := &html.Node{Type: html.ElementNode, Data: "style"}
+	if media := htmlpage.Attr(n, "media"); media != "" {
+		style.Attr = []html.Attribute{{Key: "media", Val: media}}
+	}
+	style.AppendChild(&html.Node{Type: html.TextNode, Data: css})
+	n.Parent.InsertBefore(style, n)
+	n.Parent.RemoveChild(n)
+	return true
+}
+
+// rewriteCSS resolves the url() references in css, relative to dir.
+func (b *assetBundler) rewriteCSS(css string, dir string) string {
+	return cssURL.ReplaceAllStringFunc(css, func(m string) string {
+		sub := cssURL.FindStringSubmatch(m)
+		ref, ok := b.resolve(sub[2], dir)
+		if !ok {
+			return m
+		}
+		return "url(\"" + ref + "\")"
+	})
+}
+
+// resolve returns the new reference for a local file, or false when ref is
+// not a readable local file or is too large to inline.
+func (b *assetBundler) resolve(ref string, dir string) (string, bool) {
+	filename, ok := b.localFile(ref, dir)
+	if !ok {
+		return "", false
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		b.warnings = append(b.warnings, fmt.Sprintf("assets: cannot read %v: %v", ref, err))
+		return "", false
+	}
+	contentType := assetContentType(filename, data)
+
+	if b.opts.Assets == "upload" {
+		return b.add(filename, data, contentType), true
+	}
+
+	if b.opts.InlineMax > 0 && int64(len(data)) > b.opts.InlineMax {
+		b.warnings = append(b.warnings, fmt.Sprintf("assets: %v is %v bytes, over the %v byte inline limit", ref, len(data), b.opts.InlineMax))
+		return "", false
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data), true
+}
+
+// localFile maps a reference to a file on disk. References with a scheme,
+// such as http: or data:, and fragment-only references are left alone.
+// A leading "/" is resolved against opts.Root. A reference that names a
+// file outside opts.Root, through ".." or as an absolute file path, is
+// refused with a warning, so a page cannot bundle arbitrary local files.
+func (b *assetBundler) localFile(ref string, dir string) (string, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "//") || urlScheme(ref) != "" {
+		return "", false
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+
+	var filename string
+	p := filepath.FromSlash(u.Path)
+	switch {
+	case strings.HasPrefix(u.Path, "/"):
+		filename = filepath.Join(b.opts.Root, p)
+	case filepath.IsAbs(p) || filepath.VolumeName(p) != "":
+		b.warnings = append(b.warnings, fmt.Sprintf("assets: %v is an absolute file path, left alone", ref))
+		return "", false
+	default:
+		filename = filepath.Join(dir, p)
+	}
+
+	root, err := filepath.Abs(b.opts.Root)
+	if err == nil {
+		filename, err = filepath.Abs(filename)
+	}
+	var rel string
+	if err == nil {
+		rel, err = filepath.Rel(root, filename)
+	}
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		b.warnings = append(b.warnings, fmt.Sprintf("assets: %v is outside %v, left alone", ref, b.opts.Root))
+		return "", false
+	}
+	return filename, true
+}
+
+// add records an asset for upload and returns the reference to it. The ID is
+// derived from the content, so a file shared by several pages is sent once.
+func (b *assetBundler) add(filename string, data []byte, contentType string) string {
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:8]) + strings.ToLower(filepath.Ext(filename))
+	if !b.seen[id] {
+		b.seen[id] = true
+		b.assets = append(b.assets, asset{
+			ID:          id,
+			ContentType: contentType,
+			Data:        base64.StdEncoding.EncodeToString(data),
+		})
+	}
+	return b.opts.AssetPrefix + id
+}
+
+func assetContentType(filename string, data []byte) string {
+	t := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))
+	if t == "" {
+		t = http.DetectContentType(data)
+	}
+	if i := strings.Index(t, ";"); i >= 0 {
+		t = t[:i]
+	}
+	return t
+}
+
+// hasToken reports whether the space-separated list s contains tok.
+func hasToken(s string, tok string) bool {
+	for _, f := range strings.Fields(strings.ToLower(s)) {
+		if f == tok {
+			return true
+		}
+	}
+	return false
+}
+
+// setAttr sets n's attribute key to val, adding it if needed.
+func setAttr(n *html.Node, key string, val string) {
+	for i, a := range n.Attr {
+		if a.Key == key && a.Namespace == "" {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+// removeAttr removes n's attribute key, if it has one.
+func removeAttr(n *html.Node, key string) {
+	for i, a := range n.Attr {
+		if a.Key == key && a.Namespace == "" {
+			n.Attr = append(n.Attr[:i], n.Attr[i+1:]...)
+			return
+		}
+	}
+}
+
+// sendAssets uploads the assets whose IDs are not yet in sent, marking each
+// one as it is sent.
+func sendAssets(ctx context.Context, assets []asset, sent map[string]bool) (err error) {
+	url, err := doGetLoadURL("asset")
+	if err != nil {
+		return
+	}
+	for _, a := range assets {
+		if sent[a.ID] {
+			continue
+		}
+		var payload []byte
+		payload, err = json.Marshal(a)
+		if err != nil {
+			return
+		}
+		err = apiUpsert(ctx, url, string(payload))
+		if err != nil {
+			return
+		}
+		sent[a.ID] = true
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+)
+
+func TestBundleAssetsStaysInRoot(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "content")
+	sub := filepath.Join(root, "chapter")
+	err := os.MkdirAll(sub, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		filepath.Join(base, "secret.txt"): "secret",
+		filepath.Join(root, "shared.png"): "\x89PNG\r\n\x1a\n",
+		filepath.Join(sub, "local.png"):   "\x89PNG\r\n\x1a\n",
+	} {
+		err = ioutil.WriteFile(name, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		src     string
+		inlined bool
+	}{
+		{"local.png", true},
+		{"../shared.png", true},
+		{"/shared.png", true},
+		{"./../chapter/local.png", true},
+		{"../../secret.txt", false},
+		{"../../../../../../../../etc/passwd", false},
+		{"%2e%2e/%2e%2e/secret.txt", false},
+		{"/../secret.txt", false},
+		{"file:///etc/passwd", false},
+		{"https://example.com/a.png", false},
+	}
+	opts := fullpageOptions{Assets: "inline", Root: root}
+	for _, tt := range tests {
+		fp := hb.Fullpage{Content: `<p><img src="` + tt.src + `"></p>`}
+		_, warnings, err := bundleAssets(&fp, sub, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inlined := strings.Contains(fp.Content, "data:")
+		if inlined != tt.inlined {
+			t.Errorf("%v: inlined %v, want %v (warnings %q)", tt.src, inlined, tt.inlined, warnings)
+		}
+		if strings.Contains(fp.Content, "c2VjcmV0") {
+			t.Errorf("%v: file outside the root was read", tt.src)
+		}
+	}
+}
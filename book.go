@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"github.com/rstanleyhum/hbctrl/internal/itemid"
+	"gopkg.in/yaml.v2"
+)
+
+// bookRecord is a generated Book. It is written in the JSON form that
+// hbctrlbooks loads, and uploaded through hb.Book in the same way. The
+// book table holds only the hb.Book fields, so Chapters and TOC live in the
+// book files alone, and everything that needs them reads those files.
+type bookRecord struct {
+	ID           string        `json:"id" yaml:"id"`
+	Title        string        `json:"title" yaml:"title"`
+	HandbookType string        `json:"handbookType,omitempty" yaml:"handbookType"`
+	Chapters     []bookChapter `json:"chapters" yaml:"chapters"`
+	// TOC is the heading contents of the book's pages, built when the pages
+	// are loaded with -headings, for deep links into subsections.
+	TOC []tocPage `json:"toc,omitempty" yaml:"toc,omitempty"`
+}
+
+// bookChapter is a titled, ordered list of Fullpage IDs.
+type bookChapter struct {
+	Title string   `json:"title" yaml:"title"`
+	Pages []string `json:"pages" yaml:"pages"`
+}
+
+// booksFromLayout builds one book per top-level directory of a load, and
+// one chapter per directory inside it; files directly in a book directory
+// form an untitled first chapter, and files at the top level belong to no
+// book. Books, chapters and pages are ordered by name, numeric prefixes by
+// value, and titled from the directory name with the prefix removed.
+func booksFromLayout(items []loadItem) (books []bookRecord) {
+	byBook := map[string]map[string][]loadItem{}
+	for _, item := range items {
+		parts := strings.Split(item.source(), "/")
+		if len(parts) < 2 {
+			continue
+		}
+		chapter := ""
+		if len(parts) > 2 {
+			chapter = parts[1]
+		}
+		if byBook[parts[0]] == nil {
+			byBook[parts[0]] = map[string][]loadItem{}
+		}
+		byBook[parts[0]][chapter] = append(byBook[parts[0]][chapter], item)
+	}
+
+	var dirs []string
+	for dir := range byBook {
+		dirs = append(dirs, dir)
+	}
+	sortNames(dirs)
+
+	for _, dir := range dirs {
+		book := bookRecord{ID: itemid.Slugify(trimOrderPrefix(dir)), Title: humanise(dir)}
+		chapters := byBook[dir]
+		var names []string
+		for name := range chapters {
+			names = append(names, name)
+		}
+		sortNames(names)
+		for _, name := range names {
+			pages := chapters[name]
+			sort.SliceStable(pages, func(i, j int) bool { return orderLess(pages[i].Name, pages[j].Name) })
+			ch := bookChapter{Title: humanise(name)}
+			for _, p := range pages {
+				ch.Pages = append(ch.Pages, p.ID)
+			}
+			book.Chapters = append(book.Chapters, ch)
+		}
+		books = append(books, book)
+	}
+	return
+}
+
+// sortNames sorts names with orderLess.
+func sortNames(names []string) {
+	sort.Slice(names, func(i, j int) bool { return orderLess(names[i], names[j]) })
+}
+
+// orderLess orders names by their numeric prefix, when both have one, and
+// then by name, so "2-x" comes before "10-y". The empty name comes first.
+func orderLess(a string, b string) bool {
+	if a == "" || b == "" {
+		return a == "" && b != ""
+	}
+	na, oka := orderPrefix(a)
+	nb, okb := orderPrefix(b)
+	if oka && okb && na != nb {
+		return na < nb
+	}
+	if oka != okb {
+		return oka
+	}
+	return a < b
+}
+
+func orderPrefix(name string) (int, bool) {
+	end := strings.IndexFunc(name, func(r rune) bool { return !unicode.IsDigit(r) })
+	if end < 0 {
+		end = len(name)
+	}
+	n, err := strconv.Atoi(name[:end])
+	return n, err == nil
+}
+
+// trimOrderPrefix removes a numeric ordering prefix such as "01-" or "3_".
+func trimOrderPrefix(name string) string {
+	s := strings.TrimLeftFunc(name, unicode.IsDigit)
+	s = strings.TrimLeft(s, "-_. ")
+	if s == "" {
+		return name
+	}
+	return s
+}
+
+// humanise turns a directory name into a title: "02-acute_care" becomes
+// "Acute care". A name with nothing left once the separators are removed,
+// such as "-", is its own title.
+func humanise(name string) string {
+	s := strings.NewReplacer("-", " ", "_", " ").Replace(trimOrderPrefix(name))
+	r := []rune(htmlpage.CollapseSpace(s))
+	if len(r) == 0 {
+		return name
+	}
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// readTOC reads books from a table of contents file. A YAML file (.yaml or
+// .yml) holds a list of books in the form they are written out. Any other
+// file is read as a Markdown outline:
+//
+//	# Book title {#book-id}
+//	## Chapter title
+//	- page-id
+//	- [Link text](page-id)
+//
+// A book without an {#id} takes the slug of its title.
+func readTOC(filename string) (books []bookRecord, err error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		var data []byte
+		data, err = ioutil.ReadFile(filename)
+		if err != nil {
+			return
+		}
+		err = yaml.Unmarshal(data, &books)
+		for i := range books {
+			if books[i].ID == "" {
+				books[i].ID = itemid.Slugify(books[i].Title)
+			}
+		}
+		return
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		switch {
+		case s == "":
+		case strings.HasPrefix(s, "## "):
+			if len(books) == 0 {
+				return nil, fmt.Errorf("%v:%v: chapter before any book", filename, line)
+			}
+			b := &books[len(books)-1]
+			b.Chapters = append(b.Chapters, bookChapter{Title: strings.TrimSpace(s[3:])})
+		case strings.HasPrefix(s, "# "):
+			title, id := headingID(strings.TrimSpace(s[2:]))
+			if id == "" {
+				id = itemid.Slugify(title)
+			}
+			books = append(books, bookRecord{ID: id, Title: title})
+		case strings.HasPrefix(s, "- ") || strings.HasPrefix(s, "* "):
+			if len(books) == 0 {
+				return nil, fmt.Errorf("%v:%v: page before any book", filename, line)
+			}
+			b := &books[len(books)-1]
+			if len(b.Chapters) == 0 {
+				b.Chapters = append(b.Chapters, bookChapter{})
+			}
+			ch := &b.Chapters[len(b.Chapters)-1]
+			ch.Pages = append(ch.Pages, tocPageID(strings.TrimSpace(s[2:])))
+		default:
+			return nil, fmt.Errorf("%v:%v: expected a # book, ## chapter or - page line", filename, line)
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// headingID splits "Title {#id}" into its title and ID.
+func headingID(s string) (title string, id string) {
+	if strings.HasSuffix(s, "}") {
+		if i := strings.LastIndex(s, "{#"); i >= 0 {
+			return strings.TrimSpace(s[:i]), s[i+2 : len(s)-1]
+		}
+	}
+	return s, ""
+}
+
+// tocPageID returns the page ID of a list item, which is either the ID
+// itself or a Markdown link to it. A link to a file names the page by the
+// file's base name without its extension.
+func tocPageID(s string) string {
+	if strings.HasPrefix(s, "[") {
+		if i := strings.Index(s, "]("); i >= 0 && strings.HasSuffix(s, ")") {
+			s = s[i+2 : len(s)-1]
+		}
+	}
+	base := path.Base(s)
+	for _, exts := range inputExtensions {
+		if hasExtension(base, exts) {
+			return strings.TrimSuffix(base, path.Ext(base))
+		}
+	}
+	return base
+}
+
+// checkBooks returns a problem for every page a book refers to that is not
+// among ids, and for books without an ID.
+func checkBooks(books []bookRecord, ids map[string]bool) (problems []string) {
+	for _, b := range books {
+		if b.ID == "" {
+			problems = append(problems, fmt.Sprintf("book %q has no ID", b.Title))
+		}
+		for _, ch := range b.Chapters {
+			for _, id := range ch.Pages {
+				if !ids[id] {
+					problems = append(problems, fmt.Sprintf("book %v, chapter %q: no Fullpage %v", b.ID, ch.Title, id))
+				}
+			}
+		}
+	}
+	return
+}
+
+// writeBooks writes each book to dir as <id>.json.
+func writeBooks(dir string, books []bookRecord) (err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	for _, b := range books {
+		var data []byte
+		data, err = json.MarshalIndent(b, "", "  ")
+		if err != nil {
+			return
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, b.ID+".json"), append(data, '\n'), 0644)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// sendBooks uploads the books to the book table, as drafts when draft is
+// set. Only the hb.Book fields are sent.
+func sendBooks(ctx context.Context, books []bookRecord, draft bool) (err error) {
+	url, err := doGetLoadURL("book")
+	if err != nil {
+		return
+	}
+	for _, b := range books {
+		b.ID = draftID(b.ID, draft)
+		var data []byte
+		data, err = json.Marshal(b)
+		if err != nil {
+			return
+		}
+		var bk hb.Book
+		err = json.Unmarshal(data, &bk)
+		if err != nil {
+			return
+		}
+		data, err = json.Marshal(bk)
+		if err != nil {
+			return
+		}
+		err = apiUpsert(ctx, url, string(data))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
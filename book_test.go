@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestHumanise(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"02-acute_care", "Acute care"},
+		{"paediatrics", "Paediatrics"},
+		{"3_ward  rounds", "Ward rounds"},
+		{"émergence", "Émergence"},
+		{"2020", "2020"},
+		{"01-", "01"},
+		{"-", "-"},
+		{"_", "_"},
+		{"--_", "--_"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := humanise(tt.name); got != tt.want {
+			t.Errorf("humanise(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/rstanleyhum/hbctrl/internal/run"
+)
+
+// systemFields are the columns the server adds to every item. They are left
+// out of content hashes so a server item hashes the same as the payload it
+// was created from.
+var systemFields = stringSet([]string{"createdat", "updatedat", "version", "deleted"})
+
+// manifest records the content hash of every item sent, per table, so a
+// later load can skip the items that have not changed.
+type manifest struct {
+	Tables map[string]map[string]string `json:"tables"`
+}
+
+// changeSet sorts the items of a load into unchanged, changed and new.
+type changeSet struct {
+	Unchanged []string
+	Changed   []string
+	New       []string
+	// IDs maps the name of every item to its ID.
+	IDs map[string]string
+	// Hashes holds the hash of every item, keyed by ID.
+	Hashes map[string]string
+	// MetaHashes holds the hash of the metadata of every item that sends
+	// it to the metadata table, keyed by ID.
+	MetaHashes map[string]string
+	// Send holds the items that are new or changed.
+	Send []loadItem
+}
+
+// payloadHash returns the ID of an item payload and a hash of its content
+// that does not depend on field order, formatting or server columns.
+func payloadHash(js string) (id string, hash string, err error) {
+	var fields map[string]interface{}
+	err = json.Unmarshal([]byte(js), &fields)
+	if err != nil {
+		return
+	}
+	for k, v := range fields {
+		key := strings.ToLower(k)
+		if systemFields[key] {
+			delete(fields, k)
+		}
+		if key == "id" {
+			id = fmt.Sprint(v)
+		}
+	}
+	// Maps are marshalled with sorted keys, which makes this canonical.
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(canonical)
+	return id, hex.EncodeToString(sum[:]), nil
+}
+
+// compareItems checks the items of a load against known and knownMeta, the
+// hashes the server is believed to have for the items and for the metadata
+// table, keyed by ID. An item whose metadata goes to the metadata table has
+// changed when either its payload or its metadata has.
+func compareItems(items []loadItem, known map[string]string, knownMeta map[string]string) (cs changeSet, err error) {
+	cs.IDs = map[string]string{}
+	cs.Hashes = map[string]string{}
+	cs.MetaHashes = map[string]string{}
+	for _, item := range items {
+		var js, id, hash string
+		js, err = item.payload()
+		if err != nil {
+			return
+		}
+		id, hash, err = payloadHash(js)
+		if err != nil {
+			err = fmt.Errorf("%v: %v", item.Name, err)
+			return
+		}
+		cs.IDs[item.Name] = id
+		cs.Hashes[id] = hash
+
+		metaChanged := false
+		if item.Metadata != nil && item.MetadataMode == "table" {
+			var data []byte
+			data, err = json.Marshal(item.Metadata)
+			if err != nil {
+				return
+			}
+			var mhash string
+			_, mhash, err = payloadHash(string(data))
+			if err != nil {
+				err = fmt.Errorf("%v: %v", item.Name, err)
+				return
+			}
+			cs.MetaHashes[id] = mhash
+			metaChanged = knownMeta[id] != mhash
+		}
+
+		old, ok := known[id]
+		switch {
+		case !ok:
+			cs.New = append(cs.New, item.Name)
+		case old != hash || metaChanged:
+			cs.Changed = append(cs.Changed, item.Name)
+		default:
+			cs.Unchanged = append(cs.Unchanged, item.Name)
+			continue
+		}
+		cs.Send = append(cs.Send, item)
+	}
+	return
+}
+
+// print lists the items of each kind on w, followed by the totals.
+func (cs changeSet) print(w io.Writer) {
+	for _, name := range cs.Unchanged {
+		fmt.Fprintf(w, "unchanged: %v\n", name)
+	}
+	for _, name := range cs.Changed {
+		fmt.Fprintf(w, "changed:   %v\n", name)
+	}
+	for _, name := range cs.New {
+		fmt.Fprintf(w, "new:       %v\n", name)
+	}
+	fmt.Fprintf(w, "%v unchanged, %v changed, %v new\n", len(cs.Unchanged), len(cs.Changed), len(cs.New))
+}
+
+func readManifest(filename string) (m manifest, err error) {
+	m = manifest{Tables: map[string]map[string]string{}}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &m)
+	if m.Tables == nil {
+		m.Tables = map[string]map[string]string{}
+	}
+	return
+}
+
+func writeManifest(filename string, m manifest) (err error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return
+	}
+	return run.WriteFile(filename, data)
+}
+
+// serverHashes fetches every item of the table at url and returns their
+// content hashes keyed by ID.
+func serverHashes(ctx context.Context, url string) (hashes map[string]string, err error) {
+	rows, err := serverRows(ctx, url)
+	if err != nil {
+		return
+	}
+	hashes = map[string]string{}
+	for _, r := range rows {
+		id, hash, err := payloadHash(string(r))
+		if err != nil {
+			return nil, err
+		}
+		hashes[id] = hash
+	}
+	return
+}
+
+// serverRows fetches every item of the table at url, a page at a time,
+// leaving out deleted items.
+func serverRows(ctx context.Context, url string) (rows []json.RawMessage, err error) {
+	all, err := serverQuery(ctx, url, "")
+	for _, r := range all {
+		var row struct {
+			Deleted bool `json:"deleted"`
+		}
+		if json.Unmarshal(r, &row) == nil && row.Deleted {
+			continue
+		}
+		rows = append(rows, r)
+	}
+	return
+}
+
+// serverQuery fetches every item of the table at url that query, a query
+// string such as "$filter=...", selects, a page at a time.
+func serverQuery(ctx context.Context, url string, query string) (rows []json.RawMessage, err error) {
+	if query != "" {
+		query = "&" + query
+	}
+	top := 50
+	for skip := 0; ; skip += top {
+		var payload []byte
+		payload, err = apiGet(ctx, fmt.Sprintf("%s?$top=%v&$skip=%v&$inlinecount=allpages%s", url, top, skip, query))
+		if err != nil {
+			return
+		}
+
+		var results struct {
+			Results []json.RawMessage
+			Count   int
+		}
+		err = json.Unmarshal(payload, &results)
+		if err != nil {
+			return
+		}
+		rows = append(rows, results.Results...)
+
+		if len(results.Results) == 0 || skip+top >= results.Count {
+			return
+		}
+	}
+}
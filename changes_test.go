@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+)
+
+func TestPayloadHash(t *testing.T) {
+	id, a, err := payloadHash(`{"id": "asthma", "title": "Asthma", "content": "<p>x</p>"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "asthma" {
+		t.Errorf("id %q, want asthma", id)
+	}
+	_, b, err := payloadHash(`{"content":"<p>x</p>","title":"Asthma","id":"asthma","createdAt":"2020-01-01T00:00:00Z","version":"AAA=","deleted":false}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("field order or server columns change the hash")
+	}
+	_, c, err := payloadHash(`{"id": "asthma", "title": "Asthma", "content": "<p>y</p>"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == c {
+		t.Errorf("a content change leaves the hash the same")
+	}
+}
+
+func TestCompareItems(t *testing.T) {
+	item := func(name string, content string, md *pageMetadata, mode string) loadItem {
+		return loadItem{Name: name, Page: &hb.Fullpage{ID: name, Title: name, Content: content}, Metadata: md, MetadataMode: mode}
+	}
+	hashOf := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, hash, err := payloadHash(string(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	md := &pageMetadata{ID: "meta", Description: "Old"}
+	known := map[string]string{
+		"same":    hashOf(hb.Fullpage{ID: "same", Title: "same", Content: "a"}),
+		"edited":  hashOf(hb.Fullpage{ID: "edited", Title: "edited", Content: "a"}),
+		"meta":    hashOf(hb.Fullpage{ID: "meta", Title: "meta", Content: "a"}),
+		"metaold": hashOf(hb.Fullpage{ID: "metaold", Title: "metaold", Content: "a"}),
+	}
+	knownMeta := map[string]string{
+		"meta":    hashOf(md),
+		"metaold": hashOf(&pageMetadata{ID: "metaold", Description: "Old"}),
+	}
+
+	cs, err := compareItems([]loadItem{
+		item("same", "a", nil, ""),
+		item("edited", "b", nil, ""),
+		item("added", "a", nil, ""),
+		item("meta", "a", md, "table"),
+		item("metaold", "a", &pageMetadata{ID: "metaold", Description: "New"}, "table"),
+	}, known, knownMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"same", "meta"}; !reflect.DeepEqual(cs.Unchanged, want) {
+		t.Errorf("unchanged %q, want %q", cs.Unchanged, want)
+	}
+	if want := []string{"edited", "metaold"}; !reflect.DeepEqual(cs.Changed, want) {
+		t.Errorf("changed %q, want %q", cs.Changed, want)
+	}
+	if want := []string{"added"}; !reflect.DeepEqual(cs.New, want) {
+		t.Errorf("new %q, want %q", cs.New, want)
+	}
+	if len(cs.Send) != 3 {
+		t.Errorf("%v items to send, want 3", len(cs.Send))
+	}
+	if cs.MetaHashes["metaold"] == knownMeta["metaold"] || cs.MetaHashes["meta"] != knownMeta["meta"] {
+		t.Errorf("metadata hashes %q", cs.MetaHashes)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+)
+
+// checkSet is the content that check looks at: Fullpages, books and update
+// messages, each recorded with where it came from, such as a file name or
+// "server fullpage".
+type checkSet struct {
+	pages    map[string][]string
+	books    []checkBook
+	messages []checkMessage
+}
+
+type checkBook struct {
+	bookRecord
+	Where string
+}
+
+// checkMessage is an UpdateJsonMessage, whose Items are Fullpage IDs.
+type checkMessage struct {
+	Items []string
+	Where string
+}
+
+// checkProblem prints as "where: rule: message", like lint diagnostics.
+type checkProblem struct {
+	Where   string
+	Rule    string
+	Message string
+}
+
+func (p checkProblem) String() string {
+	return fmt.Sprintf("%v: %v: %v", p.Where, p.Rule, p.Message)
+}
+
+func newCheckSet() *checkSet {
+	return &checkSet{pages: map[string][]string{}}
+}
+
+func (c *checkSet) addPage(id string, where string) {
+	c.pages[id] = append(c.pages[id], where)
+}
+
+// addLocal adds the pages of a load.
+func (c *checkSet) addLocal(items []loadItem) {
+	for _, item := range items {
+		if item.ID != "" {
+			c.addPage(item.ID, item.Name)
+		}
+	}
+}
+
+// readBookFiles adds the books in the JSON files at path, a file or a
+// directory. Each file holds a book or an array of books in the form book
+// build writes.
+func (c *checkSet) readBookFiles(path string) (err error) {
+	return eachJSONFile(path, func(name string, data []byte) error {
+		list, err := decodeBooks(data)
+		for _, b := range list {
+			c.books = append(c.books, checkBook{bookRecord: b, Where: name})
+		}
+		return err
+	})
+}
+
+// decodeBooks decodes a book, or an array of books, in the form book build
+// writes. A book without a "chapters" field, such as one in the hb.Book
+// form hbctrlbooks loads, says nothing about its pages and is an error
+// rather than an empty book.
+func decodeBooks(data []byte) (books []bookRecord, err error) {
+	rows := []json.RawMessage{data}
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		err = json.Unmarshal(data, &rows)
+		if err != nil {
+			return
+		}
+	}
+	for _, r := range rows {
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(r, &fields)
+		if err != nil {
+			return nil, err
+		}
+		var b bookRecord
+		err = json.Unmarshal(r, &b)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fields["chapters"]; !ok {
+			return nil, fmt.Errorf("book %q has no chapters; write book files with book build", b.ID)
+		}
+		books = append(books, b)
+	}
+	return
+}
+
+// readMessageFiles adds the update messages in the JSON files at path, a
+// file or a directory. A file is either an UpdateJsonMessage, as loaded into
+// userupdatestatus, or an InitialUpdateJson whose updateJson holds one.
+func (c *checkSet) readMessageFiles(path string) (err error) {
+	return eachJSONFile(path, func(name string, data []byte) error {
+		msg, err := decodeMessage(data)
+		if err != nil {
+			return err
+		}
+		msg.Where = name
+		c.messages = append(c.messages, msg)
+		return nil
+	})
+}
+
+// decodeMessage decodes an UpdateJsonMessage, or a row that carries one as a
+// string in its updateJson field.
+func decodeMessage(data []byte) (msg checkMessage, err error) {
+	var row struct {
+		UpdateJson string `json:"updateJson"`
+		Items      []string
+	}
+	err = json.Unmarshal(data, &row)
+	if err != nil || row.UpdateJson == "" {
+		msg.Items = row.Items
+		return
+	}
+	var ujm hb.UpdateJsonMessage
+	err = json.Unmarshal([]byte(row.UpdateJson), &ujm)
+	msg.Items = ujm.Items
+	return
+}
+
+// eachJSONFile calls fn with the contents of path, or of every .json file in
+// it when it is a directory.
+func eachJSONFile(path string, fn func(name string, data []byte) error) (err error) {
+	names := []string{path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		names, err = filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return
+		}
+	}
+	for _, name := range names {
+		var data []byte
+		data, err = ioutil.ReadFile(name)
+		if err != nil {
+			return
+		}
+		err = fn(name, data)
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	return
+}
+
+// readServer adds the Fullpages and update messages of the server tables.
+// The book table is not read: it does not hold the books' chapters, which
+// come from the book files.
+func (c *checkSet) readServer(ctx context.Context) (err error) {
+	for _, table := range []string{"fullpage", "initialupdatejson", "userupdatestatus"} {
+		var url string
+		url, err = doGetLoadURL(table)
+		if err != nil {
+			return
+		}
+		var rows []json.RawMessage
+		rows, err = serverRows(ctx, url)
+		if err != nil {
+			return fmt.Errorf("%v: %v", table, err)
+		}
+		for _, r := range rows {
+			var row struct {
+				ID string `json:"id"`
+			}
+			err = json.Unmarshal(r, &row)
+			if err != nil {
+				return fmt.Errorf("%v: %v", table, err)
+			}
+			// Drafts are not live until they are published.
+			if strings.HasPrefix(row.ID, draftPrefix) {
+				continue
+			}
+			where := fmt.Sprintf("server %v %v", table, row.ID)
+			switch table {
+			case "fullpage":
+				c.addPage(row.ID, "server fullpage")
+			default:
+				var msg checkMessage
+				msg, err = decodeMessage(r)
+				if err != nil {
+					return fmt.Errorf("%v: %v", where, err)
+				}
+				msg.Where = where
+				c.messages = append(c.messages, msg)
+			}
+		}
+	}
+	return
+}
+
+// check reports references from books and update messages to Fullpages that
+// are neither in the load nor on the server, pages that no book includes,
+// and IDs used by more than one page of a load, more than one book, or by
+// both a page and a book. A page on the server and in the load is the same
+// page and is not a duplicate. Orphans are only looked for when there are
+// books to look in.
+func (c *checkSet) check() (problems []checkProblem) {
+	included := map[string]bool{}
+	for _, b := range c.books {
+		for _, ch := range b.Chapters {
+			for _, id := range ch.Pages {
+				included[id] = true
+				if len(c.pages[id]) == 0 {
+					problems = append(problems, checkProblem{b.Where, "dangling", fmt.Sprintf("book %v, chapter %q: no Fullpage %v", b.ID, ch.Title, id)})
+				}
+			}
+		}
+	}
+	for _, m := range c.messages {
+		for _, id := range m.Items {
+			if len(c.pages[id]) == 0 {
+				problems = append(problems, checkProblem{m.Where, "dangling", fmt.Sprintf("update message: no Fullpage %v", id)})
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(c.pages))
+	for id := range c.pages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	if len(c.books) > 0 {
+		for _, id := range ids {
+			if !included[id] {
+				problems = append(problems, checkProblem{c.pages[id][0], "orphan", fmt.Sprintf("Fullpage %v is in no book", id)})
+			}
+		}
+	}
+
+	for _, id := range ids {
+		var local []string
+		for _, where := range c.pages[id] {
+			if !strings.HasPrefix(where, "server ") {
+				local = append(local, where)
+			}
+		}
+		if len(local) > 1 {
+			problems = append(problems, checkProblem{local[0], "duplicate", fmt.Sprintf("Fullpage %v also from %v", id, strings.Join(local[1:], ", "))})
+		}
+	}
+
+	books := map[string][]checkBook{}
+	var bookIDs []string
+	for _, b := range c.books {
+		if _, ok := books[b.ID]; !ok {
+			bookIDs = append(bookIDs, b.ID)
+		}
+		books[b.ID] = append(books[b.ID], b)
+	}
+	for _, id := range bookIDs {
+		list := books[id]
+		var local []string
+		for _, b := range list {
+			if !strings.HasPrefix(b.Where, "server ") {
+				local = append(local, b.Where)
+			}
+		}
+		if len(local) > 1 {
+			problems = append(problems, checkProblem{local[0], "duplicate", fmt.Sprintf("book %v also in %v", id, strings.Join(local[1:], ", "))})
+		}
+		if pages := c.pages[id]; len(pages) > 0 {
+			problems = append(problems, checkProblem{list[0].Where, "duplicate", fmt.Sprintf("book %v has the ID of the Fullpage from %v", id, pages[0])})
+		}
+	}
+	return
+}
+
+// printCheck writes the problems to w and a summary line.
+func printCheck(w io.Writer, c *checkSet, problems []checkProblem) {
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+	fmt.Fprintf(w, "check: %v pages, %v books, %v update messages, %v problems\n", len(c.pages), len(c.books), len(c.messages), len(problems))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBooks(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []bookRecord
+		err  string
+	}{
+		{
+			name: "one book",
+			data: `{"id": "asthma", "title": "Asthma", "chapters": [{"title": "", "pages": ["a", "b"]}]}`,
+			want: []bookRecord{{ID: "asthma", Title: "Asthma", Chapters: []bookChapter{{Pages: []string{"a", "b"}}}}},
+		},
+		{
+			name: "array of books",
+			data: ` [{"id": "one", "chapters": []}, {"id": "two", "chapters": [{"title": "T", "pages": ["x"]}]}]`,
+			want: []bookRecord{
+				{ID: "one", Chapters: []bookChapter{}},
+				{ID: "two", Chapters: []bookChapter{{Title: "T", Pages: []string{"x"}}}},
+			},
+		},
+		{
+			name: "hb.Book form",
+			data: `{"id": "asthma", "title": "Asthma", "handbookType": "adult"}`,
+			err:  `book "asthma" has no chapters`,
+		},
+		{
+			name: "hb.Book form in an array",
+			data: `[{"id": "one", "chapters": []}, {"id": "two", "title": "Two"}]`,
+			err:  `book "two" has no chapters`,
+		},
+		{
+			name: "not an object",
+			data: `"asthma"`,
+			err:  "cannot unmarshal",
+		},
+	}
+	for _, tt := range tests {
+		got, err := decodeBooks([]byte(tt.data))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
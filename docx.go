@@ -0,0 +1,774 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"golang.org/x/net/html"
+)
+
+// xmlNode is a generic element of an OOXML part.
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Text    string     `xml:",chardata"`
+	Nodes   []xmlNode  `xml:",any"`
+}
+
+// child returns the first child element with the given local name.
+func (n *xmlNode) child(local string) *xmlNode {
+	if n == nil {
+		return nil
+	}
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == local {
+			return &n.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// find returns the first descendant element with the given local name.
+func (n *xmlNode) find(local string) *xmlNode {
+	if n == nil {
+		return nil
+	}
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == local {
+			return &n.Nodes[i]
+		}
+		if f := n.Nodes[i].find(local); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// attr returns the attribute with the given local name, whatever its
+// namespace.
+func (n *xmlNode) attr(local string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.Attrs {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// on reports whether a toggle property such as <w:b/> is set.
+func (n *xmlNode) on() bool {
+	if n == nil {
+		return false
+	}
+	switch n.attr("val") {
+	case "0", "false", "off":
+		return false
+	}
+	return true
+}
+
+// docxRel is one relationship of the main document part.
+type docxRel struct {
+	Target   string
+	External bool
+}
+
+// docxStyle is the part of a paragraph style the converter uses.
+type docxStyle struct {
+	Name  string
+	NumID string
+	Ilvl  string
+}
+
+// docxPiece is a run of inline HTML with its formatting.
+type docxPiece struct {
+	html         string
+	bold, italic bool
+}
+
+// docxInline is the converted content of a paragraph.
+type docxInline struct {
+	html string
+	text string
+	// ids are the bookmarks in the paragraph.
+	ids   []string
+	image bool
+}
+
+// docxConverter converts the main document part of a .docx package to
+// HTML.
+type docxConverter struct {
+	files  map[string]*zip.File
+	rels   map[string]docxRel
+	styles map[string]docxStyle
+	// lists maps a numbering ID and level to its number format.
+	lists map[string]map[string]string
+	// images maps the src of each converted image to its part name.
+	images map[string]string
+	props  map[string]string
+
+	b            strings.Builder
+	listStack    []string
+	firstHeading string
+}
+
+// readDocx opens a .docx package and reads the parts the conversion needs.
+func readDocx(filename string) (c *docxConverter, body *xmlNode, err error) {
+	// The package is read into memory so its parts stay readable after
+	// this returns.
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return
+	}
+
+	c = &docxConverter{
+		files:  map[string]*zip.File{},
+		rels:   map[string]docxRel{},
+		styles: map[string]docxStyle{},
+		lists:  map[string]map[string]string{},
+		images: map[string]string{},
+		props:  map[string]string{},
+	}
+	for _, f := range r.File {
+		c.files[f.Name] = f
+	}
+
+	doc, err := c.part("word/document.xml")
+	if err != nil {
+		return
+	}
+	if doc == nil {
+		err = errors.New("not a Word document: no word/document.xml")
+		return
+	}
+	body = doc.child("body")
+	if body == nil {
+		err = errors.New("word/document.xml has no body")
+		return
+	}
+
+	rels, err := c.part("word/_rels/document.xml.rels")
+	if err != nil {
+		return
+	}
+	if rels != nil {
+		for _, rel := range rels.Nodes {
+			c.rels[rel.attr("Id")] = docxRel{Target: rel.attr("Target"), External: rel.attr("TargetMode") == "External"}
+		}
+	}
+
+	styles, err := c.part("word/styles.xml")
+	if err != nil {
+		return
+	}
+	if styles != nil {
+		for _, s := range styles.Nodes {
+			if s.XMLName.Local != "style" {
+				continue
+			}
+			numPr := s.child("pPr").child("numPr")
+			c.styles[s.attr("styleId")] = docxStyle{
+				Name:  strings.ToLower(s.child("name").attr("val")),
+				NumID: numPr.child("numId").attr("val"),
+				Ilvl:  numPr.child("ilvl").attr("val"),
+			}
+		}
+	}
+
+	numbering, err := c.part("word/numbering.xml")
+	if err != nil {
+		return
+	}
+	if numbering != nil {
+		abstract := map[string]map[string]string{}
+		for _, a := range numbering.Nodes {
+			if a.XMLName.Local != "abstractNum" {
+				continue
+			}
+			levels := map[string]string{}
+			for _, l := range a.Nodes {
+				if l.XMLName.Local == "lvl" {
+					levels[l.attr("ilvl")] = l.child("numFmt").attr("val")
+				}
+			}
+			abstract[a.attr("abstractNumId")] = levels
+		}
+		for _, n := range numbering.Nodes {
+			if n.XMLName.Local == "num" {
+				c.lists[n.attr("numId")] = abstract[n.child("abstractNumId").attr("val")]
+			}
+		}
+	}
+
+	core, err := c.part("docProps/core.xml")
+	if err != nil {
+		return
+	}
+	if core != nil {
+		fields := map[string]string{"title": "title", "description": "description", "keywords": "keywords", "creator": "author"}
+		for _, n := range core.Nodes {
+			if key, ok := fields[n.XMLName.Local]; ok && strings.TrimSpace(n.Text) != "" {
+				c.props[key] = strings.TrimSpace(n.Text)
+			}
+		}
+	}
+	return
+}
+
+// part parses the XML part name, returning nil when the package has none.
+func (c *docxConverter) part(name string) (n *xmlNode, err error) {
+	data, err := c.read(name)
+	if err != nil || data == nil {
+		return
+	}
+	n = &xmlNode{}
+	err = xml.Unmarshal(data, n)
+	if err != nil {
+		err = fmt.Errorf("%v: %v", name, err)
+	}
+	return
+}
+
+func (c *docxConverter) read(name string) (data []byte, err error) {
+	f, ok := c.files[name]
+	if !ok {
+		return
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// convert returns the body of the document as HTML.
+func (c *docxConverter) convert(body *xmlNode) string {
+	c.blocks(body)
+	c.closeLists()
+	return c.b.String()
+}
+
+// title is the title from the document properties, or else the text of
+// the first heading.
+func (c *docxConverter) title() string {
+	if t := c.props["title"]; t != "" {
+		return t
+	}
+	return c.firstHeading
+}
+
+func (c *docxConverter) blocks(n *xmlNode) {
+	for i := range n.Nodes {
+		el := &n.Nodes[i]
+		switch el.XMLName.Local {
+		case "p":
+			c.paragraph(el)
+		case "tbl":
+			c.closeLists()
+			c.table(el)
+		case "sdt":
+			if content := el.child("sdtContent"); content != nil {
+				c.blocks(content)
+			}
+		case "customXml", "ins":
+			c.blocks(el)
+		}
+	}
+}
+
+func (c *docxConverter) paragraph(p *xmlNode) {
+	pPr := p.child("pPr")
+	styleID := pPr.child("pStyle").attr("val")
+	style := c.styles[styleID]
+
+	numID := pPr.child("numPr").child("numId").attr("val")
+	ilvl := pPr.child("numPr").child("ilvl").attr("val")
+	if numID == "" {
+		numID, ilvl = style.NumID, style.Ilvl
+	}
+	if ilvl == "" {
+		ilvl = "0"
+	}
+
+	in := c.inline(p)
+	if strings.TrimSpace(in.text) == "" && !in.image {
+		return
+	}
+
+	level := headingLevel(styleID, style.Name)
+	switch {
+	case level > 0:
+		c.closeLists()
+		text := htmlpage.CollapseSpace(in.text)
+		if c.firstHeading == "" {
+			c.firstHeading = text
+		}
+		tag := fmt.Sprintf("h%v", level)
+		c.b.WriteString("<" + tag + idAttr(in.ids) + ">" + in.html + "</" + tag + ">\n")
+	case numID != "" && numID != "0":
+		c.listItem(numID, ilvl, in)
+	default:
+		c.closeLists()
+		c.b.WriteString("<p" + idAttr(in.ids) + ">" + in.html + "</p>\n")
+	}
+}
+
+// headingLevel returns the heading level of a paragraph style, or 0 for
+// other styles. The Title style counts as a level 1 heading.
+func headingLevel(styleID string, name string) int {
+	if name == "" {
+		name = strings.ToLower(styleID)
+	}
+	name = strings.Replace(name, " ", "", -1)
+	if name == "title" {
+		return 1
+	}
+	if !strings.HasPrefix(name, "heading") {
+		return 0
+	}
+	level, err := strconv.Atoi(strings.TrimPrefix(name, "heading"))
+	if err != nil || level < 1 {
+		return 0
+	}
+	if level > 6 {
+		level = 6
+	}
+	return level
+}
+
+func idAttr(ids []string) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	return ` id="` + html.EscapeString(ids[0]) + `"`
+}
+
+// listItem writes a list paragraph, opening and closing nested lists to
+// reach its level. A nested list is opened inside the open item of its
+// parent; where the document skips a level, an unmarked item is opened to
+// hold it.
+func (c *docxConverter) listItem(numID string, ilvl string, in docxInline) {
+	level, _ := strconv.Atoi(ilvl)
+	tag := c.listTag(numID, ilvl)
+
+	for len(c.listStack) > level+1 {
+		c.closeList()
+	}
+	if len(c.listStack) == level+1 {
+		if c.listStack[level] == tag {
+			c.b.WriteString("</li>\n")
+		} else {
+			c.closeList()
+		}
+	}
+	for opened := false; len(c.listStack) < level+1; opened = true {
+		if opened {
+			c.b.WriteString(`<li style="list-style-type: none">` + "\n")
+		}
+		t := tag
+		if len(c.listStack) < level {
+			t = c.listTag(numID, strconv.Itoa(len(c.listStack)))
+		}
+		c.listStack = append(c.listStack, t)
+		c.b.WriteString("<" + t + ">\n")
+	}
+	c.b.WriteString("<li" + idAttr(in.ids) + ">" + in.html)
+}
+
+// listTag returns the list element for a level of a numbering.
+func (c *docxConverter) listTag(numID string, ilvl string) string {
+	if f := c.lists[numID][ilvl]; f == "bullet" || f == "none" {
+		return "ul"
+	}
+	return "ol"
+}
+
+func (c *docxConverter) closeList() {
+	n := len(c.listStack)
+	c.b.WriteString("</li>\n</" + c.listStack[n-1] + ">\n")
+	c.listStack = c.listStack[:n-1]
+}
+
+func (c *docxConverter) closeLists() {
+	for len(c.listStack) > 0 {
+		c.closeList()
+	}
+}
+
+// docxCell is one cell of a table row, placed on the table grid.
+type docxCell struct {
+	node   *xmlNode
+	col    int
+	span   int
+	vMerge string
+}
+
+func (c *docxConverter) table(tbl *xmlNode) {
+	var rows [][]docxCell
+	var header []bool
+	for i := range tbl.Nodes {
+		tr := &tbl.Nodes[i]
+		if tr.XMLName.Local != "tr" {
+			continue
+		}
+		var cells []docxCell
+		col := 0
+		for j := range tr.Nodes {
+			tc := &tr.Nodes[j]
+			if tc.XMLName.Local != "tc" {
+				continue
+			}
+			tcPr := tc.child("tcPr")
+			span, err := strconv.Atoi(tcPr.child("gridSpan").attr("val"))
+			if err != nil || span < 1 {
+				span = 1
+			}
+			vMerge := ""
+			if vm := tcPr.child("vMerge"); vm != nil {
+				vMerge = vm.attr("val")
+				if vMerge == "" {
+					vMerge = "continue"
+				}
+			}
+			cells = append(cells, docxCell{node: tc, col: col, span: span, vMerge: vMerge})
+			col += span
+		}
+		rows = append(rows, cells)
+		header = append(header, tr.child("trPr").child("tblHeader").on())
+	}
+
+	c.b.WriteString("<table>\n")
+	for i, cells := range rows {
+		c.b.WriteString("<tr>")
+		for _, cell := range cells {
+			if cell.vMerge == "continue" {
+				continue
+			}
+			attrs := ""
+			if cell.span > 1 {
+				attrs += fmt.Sprintf(` colspan="%v"`, cell.span)
+			}
+			if cell.vMerge == "restart" {
+				if n := mergedRows(rows[i+1:], cell.col); n > 0 {
+					attrs += fmt.Sprintf(` rowspan="%v"`, n+1)
+				}
+			}
+			tag := "td"
+			if header[i] {
+				tag = "th"
+				attrs += ` scope="col"`
+			}
+			c.b.WriteString("<" + tag + attrs + ">")
+			c.cell(cell.node)
+			c.b.WriteString("</" + tag + ">")
+		}
+		c.b.WriteString("</tr>\n")
+	}
+	c.b.WriteString("</table>\n")
+}
+
+// mergedRows counts the rows that continue a vertical merge at col.
+func mergedRows(rows [][]docxCell, col int) (n int) {
+	for _, cells := range rows {
+		found := false
+		for _, cell := range cells {
+			if cell.col == col && cell.vMerge == "continue" {
+				found = true
+			}
+		}
+		if !found {
+			return
+		}
+		n++
+	}
+	return
+}
+
+// cell writes the content of a table cell. A cell holding one plain
+// paragraph is written without the <p>.
+func (c *docxConverter) cell(tc *xmlNode) {
+	var paras []*xmlNode
+	other := false
+	for i := range tc.Nodes {
+		switch tc.Nodes[i].XMLName.Local {
+		case "p":
+			paras = append(paras, &tc.Nodes[i])
+		case "tcPr":
+		default:
+			other = true
+		}
+	}
+	if !other && len(paras) == 1 {
+		pPr := paras[0].child("pPr")
+		styleID := pPr.child("pStyle").attr("val")
+		if pPr.child("numPr") == nil && headingLevel(styleID, c.styles[styleID].Name) == 0 {
+			c.b.WriteString(c.inline(paras[0]).html)
+			return
+		}
+	}
+
+	saved := c.listStack
+	c.listStack = nil
+	c.blocks(tc)
+	c.closeLists()
+	c.listStack = saved
+}
+
+// inline converts the runs, hyperlinks and images of a paragraph.
+func (c *docxConverter) inline(p *xmlNode) (in docxInline) {
+	var pieces []docxPiece
+	var text strings.Builder
+
+	var walk func(n *xmlNode)
+	walk = func(n *xmlNode) {
+		for i := range n.Nodes {
+			el := &n.Nodes[i]
+			switch el.XMLName.Local {
+			case "r":
+				rPr := el.child("rPr")
+				bold, italic := rPr.child("b").on(), rPr.child("i").on()
+				for j := range el.Nodes {
+					h, t, img := c.runContent(&el.Nodes[j])
+					if h == "" {
+						continue
+					}
+					in.image = in.image || img
+					text.WriteString(t)
+					pieces = append(pieces, docxPiece{html: h, bold: bold, italic: italic})
+				}
+			case "hyperlink":
+				inner := c.inline(el)
+				in.image = in.image || inner.image
+				in.ids = append(in.ids, inner.ids...)
+				text.WriteString(inner.text)
+				href := ""
+				if rel, ok := c.rels[el.attr("id")]; ok && rel.External {
+					href = rel.Target
+				}
+				if anchor := el.attr("anchor"); anchor != "" {
+					href += "#" + anchor
+				}
+				h := inner.html
+				if href != "" {
+					h = `<a href="` + html.EscapeString(href) + `">` + h + "</a>"
+				}
+				pieces = append(pieces, docxPiece{html: h})
+			case "bookmarkStart":
+				if name := el.attr("name"); name != "" && name != "_GoBack" {
+					in.ids = append(in.ids, name)
+				}
+			case "ins", "smartTag", "customXml", "fldSimple":
+				walk(el)
+			case "sdt":
+				if content := el.child("sdtContent"); content != nil {
+					walk(content)
+				}
+			}
+		}
+	}
+	walk(p)
+
+	in.html = renderPieces(pieces)
+	in.text = text.String()
+	return
+}
+
+// runContent converts one child of a run, returning its HTML, its text and
+// whether it is an image.
+func (c *docxConverter) runContent(n *xmlNode) (h string, text string, image bool) {
+	switch n.XMLName.Local {
+	case "t":
+		return html.EscapeString(n.Text), n.Text, false
+	case "tab":
+		return " ", " ", false
+	case "noBreakHyphen":
+		return "-", "-", false
+	case "br", "cr":
+		if n.attr("type") == "page" {
+			return "", "", false
+		}
+		return "<br>", " ", false
+	case "drawing":
+		blip := n.find("blip")
+		doc := n.find("docPr")
+		alt := doc.attr("descr")
+		if alt == "" {
+			alt = doc.attr("title")
+		}
+		size := ""
+		if ext := n.find("extent"); ext != nil {
+			// Extents are in EMUs, 9525 to a CSS pixel.
+			cx, _ := strconv.Atoi(ext.attr("cx"))
+			cy, _ := strconv.Atoi(ext.attr("cy"))
+			if cx > 0 && cy > 0 {
+				size = fmt.Sprintf(` width="%v" height="%v"`, cx/9525, cy/9525)
+			}
+		}
+		return c.image(blip.attr("embed"), alt, size)
+	case "pict", "object":
+		data := n.find("imagedata")
+		return c.image(data.attr("id"), data.attr("title"), "")
+	}
+	return "", "", false
+}
+
+// image returns an <img> for the image relationship id. Its src is the
+// image's path within the package, resolved by docxEmbedImages.
+func (c *docxConverter) image(id string, alt string, size string) (string, string, bool) {
+	rel, ok := c.rels[id]
+	if !ok || rel.External {
+		return "", "", false
+	}
+	name := path.Clean(path.Join("word", rel.Target))
+	src := strings.TrimPrefix(name, "word/")
+	c.images[src] = name
+	return `<img src="` + html.EscapeString(src) + `" alt="` + html.EscapeString(alt) + `"` + size + `>`, "", true
+}
+
+// renderPieces joins pieces, wrapping runs of the same formatting in
+// <strong> and <em> once.
+func renderPieces(pieces []docxPiece) string {
+	var b strings.Builder
+	for i := 0; i < len(pieces); {
+		j := i
+		var group strings.Builder
+		for j < len(pieces) && pieces[j].bold == pieces[i].bold && pieces[j].italic == pieces[i].italic {
+			group.WriteString(pieces[j].html)
+			j++
+		}
+		h := group.String()
+		if pieces[i].italic {
+			h = "<em>" + h + "</em>"
+		}
+		if pieces[i].bold {
+			h = "<strong>" + h + "</strong>"
+		}
+		b.WriteString(h)
+		i = j
+	}
+	return b.String()
+}
+
+// docxDocument wraps the converted body in a document, or in the page
+// layout when one is configured.
+func docxDocument(id string, title string, body string, opts fullpageOptions) (string, error) {
+	if opts.Layouts != nil {
+		return wrapFragment(id, body, map[string]string{"title": title}, opts)
+	}
+	return "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>" + html.EscapeString(title) + "</title>\n</head>\n<body>\n" + body + "</body>\n</html>\n", nil
+}
+
+// doLoadDocx converts a Word document into a Fullpage. Its title comes from
+// the document properties, or else the first heading; the description,
+// keywords and author properties are available as metadata.
+func doLoadDocx(table string, filename string, opts fullpageOptions) (item loadItem, err error) {
+	if table != "fullpage" {
+		err = errors.New("No table defined")
+		return
+	}
+	id, err := fullpageID(filepath.Base(filename), opts)
+	if err != nil {
+		return
+	}
+
+	c, body, err := readDocx(filename)
+	if err != nil {
+		return
+	}
+	converted := c.convert(body)
+	content, err := docxDocument(id, c.title(), converted, opts)
+	if err != nil {
+		return
+	}
+
+	// The package has no local files to bundle; its images are handled by
+	// docxEmbedImages once the page has been sanitised.
+	pageOpts := opts
+	pageOpts.Assets = "off"
+	item, err = fullpageItem(filename, id, content, c.props, pageOpts)
+	if err != nil {
+		return
+	}
+
+	assets, warnings, err := c.embedImages(item.Page, opts)
+	if err != nil {
+		return
+	}
+	item.Assets = append(item.Assets, assets...)
+	item.Warnings = append(item.Warnings, warnings...)
+	return
+}
+
+// embedImages replaces the package paths of the document's images with
+// asset references in "upload" mode, and with data URIs otherwise, since
+// the images exist nowhere else. An image over opts.InlineMax cannot be
+// inlined and is left out, keeping its alt text, with a warning.
+func (c *docxConverter) embedImages(fp *hb.Fullpage, opts fullpageOptions) (assets []asset, warnings []string, err error) {
+	if len(c.images) == 0 {
+		return
+	}
+	doc, err := html.Parse(strings.NewReader(fp.Content))
+	if err != nil {
+		return
+	}
+
+	b := &assetBundler{opts: opts, seen: map[string]bool{}}
+	var walk func(*html.Node) error
+	walk = func(n *html.Node) error {
+		if n.Type == html.ElementNode && n.Data == "img" {
+			if name, ok := c.images[htmlpage.Attr(n, "src")]; ok {
+				data, err := c.read(name)
+				if err != nil {
+					return err
+				}
+				contentType := assetContentType(name, data)
+				switch {
+				case opts.Assets == "upload":
+					setAttr(n, "src", b.add(name, data, contentType))
+				case opts.InlineMax > 0 && int64(len(data)) > opts.InlineMax:
+					warnings = append(warnings, fmt.Sprintf("assets: %v is %v bytes, over the %v byte inline limit, left out", name, len(data), opts.InlineMax))
+					removeAttr(n, "src")
+				default:
+					setAttr(n, "src", "data:"+contentType+";base64,"+base64.StdEncoding.EncodeToString(data))
+				}
+			}
+		}
+		for ch := n.FirstChild; ch != nil; ch = ch.NextSibling {
+			if err := walk(ch); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = walk(doc)
+	if err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	err = html.Render(&buf, doc)
+	if err != nil {
+		return
+	}
+	fp.Content = buf.String()
+	return b.assets, warnings, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const docxNS = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" xmlns:wp="http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing" xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" xmlns:pic="http://schemas.openxmlformats.org/drawingml/2006/picture"`
+
+const docxNumbering = `<?xml version="1.0" encoding="UTF-8"?>
+<w:numbering ` + docxNS + `>
+<w:abstractNum w:abstractNumId="0">
+<w:lvl w:ilvl="0"><w:numFmt w:val="bullet"/></w:lvl>
+<w:lvl w:ilvl="1"><w:numFmt w:val="bullet"/></w:lvl>
+<w:lvl w:ilvl="2"><w:numFmt w:val="bullet"/></w:lvl>
+</w:abstractNum>
+<w:abstractNum w:abstractNumId="1">
+<w:lvl w:ilvl="0"><w:numFmt w:val="decimal"/></w:lvl>
+<w:lvl w:ilvl="1"><w:numFmt w:val="lowerLetter"/></w:lvl>
+</w:abstractNum>
+<w:num w:numId="1"><w:abstractNumId w:val="0"/></w:num>
+<w:num w:numId="2"><w:abstractNumId w:val="1"/></w:num>
+</w:numbering>`
+
+const docxStyles = `<?xml version="1.0" encoding="UTF-8"?>
+<w:styles ` + docxNS + `>
+<w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/></w:style>
+<w:style w:type="paragraph" w:styleId="Heading2"><w:name w:val="heading 2"/></w:style>
+</w:styles>`
+
+const docxRels = `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink" Target="https://example.com/" TargetMode="External"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="media/image1.png"/>
+</Relationships>`
+
+// docxPNG is a 1x1 PNG.
+var docxPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89\x00\x00\x00\rIDATx\x9cc\xf8\x0f\x00\x00\x01\x01\x00\x05\x18\xd8N\x00\x00\x00\x00IEND\xaeB`\x82")
+
+// writeDocx writes a .docx package whose body holds paragraphs, and returns
+// its file name.
+func writeDocx(t *testing.T, name string, paragraphs ...string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	parts := map[string][]byte{
+		"word/document.xml":            []byte(`<?xml version="1.0" encoding="UTF-8"?><w:document ` + docxNS + `><w:body>` + strings.Join(paragraphs, "\n") + `</w:body></w:document>`),
+		"word/_rels/document.xml.rels": []byte(docxRels),
+		"word/styles.xml":              []byte(docxStyles),
+		"word/numbering.xml":           []byte(docxNumbering),
+		"word/media/image1.png":        docxPNG,
+	}
+	for name, data := range parts {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func docxPara(style string, runs string) string {
+	pPr := ""
+	if style != "" {
+		pPr = `<w:pPr><w:pStyle w:val="` + style + `"/></w:pPr>`
+	}
+	return `<w:p>` + pPr + runs + `</w:p>`
+}
+
+func docxListPara(numID string, ilvl string, text string) string {
+	return `<w:p><w:pPr><w:numPr><w:ilvl w:val="` + ilvl + `"/><w:numId w:val="` + numID + `"/></w:numPr></w:pPr><w:r><w:t>` + text + `</w:t></w:r></w:p>`
+}
+
+func docxRun(text string, props string) string {
+	return `<w:r><w:rPr>` + props + `</w:rPr><w:t xml:space="preserve">` + text + `</w:t></w:r>`
+}
+
+const docxImageRun = `<w:r><w:drawing><wp:inline><wp:extent cx="952500" cy="476250"/><wp:docPr id="1" name="Picture 1" descr="A chart"/><a:graphic><a:graphicData><pic:pic><pic:blipFill><a:blip r:embed="rId2"/></pic:blipFill></pic:pic></a:graphicData></a:graphic></wp:inline></w:drawing></w:r>`
+
+func convertDocx(t *testing.T, paragraphs ...string) string {
+	t.Helper()
+	c, body, err := readDocx(writeDocx(t, "test.docx", paragraphs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.convert(body)
+}
+
+func TestDocxParagraphs(t *testing.T) {
+	got := convertDocx(t,
+		docxPara("Heading1", docxRun("Asthma", "")),
+		docxPara("", docxRun("Give ", "")+docxRun("oxygen", "<w:b/>")+docxRun(" and ", "")+docxRun("salbutamol", "<w:i/>")+docxRun(" now.", "")),
+		docxPara("", docxRun("  ", "")),
+		docxPara("", `<w:bookmarkStart w:id="0" w:name="dosing"/>`+docxRun("See ", "")+`<w:hyperlink r:id="rId1">`+docxRun("guidance", "")+`</w:hyperlink>`),
+		docxPara("Heading2", docxRun("Bold ", "<w:b/>")+docxRun("and italic", `<w:b/><w:i/>`)),
+	)
+	want := `<h1>Asthma</h1>
+<p>Give <strong>oxygen</strong> and <em>salbutamol</em> now.</p>
+<p id="dosing">See <a href="https://example.com/">guidance</a></p>
+<h2><strong>Bold </strong><strong><em>and italic</em></strong></h2>
+`
+	if got != want {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestDocxLists(t *testing.T) {
+	tests := []struct {
+		name       string
+		paragraphs []string
+		want       string
+	}{
+		{
+			name: "nested bullets",
+			paragraphs: []string{
+				docxListPara("1", "0", "one"),
+				docxListPara("1", "1", "one.a"),
+				docxListPara("1", "0", "two"),
+			},
+			want: "<ul>\n<li>one<ul>\n<li>one.a</li>\n</ul>\n</li>\n<li>two</li>\n</ul>\n",
+		},
+		{
+			name: "numbered list with lettered sublist",
+			paragraphs: []string{
+				docxListPara("2", "0", "first"),
+				docxListPara("2", "1", "detail"),
+				docxListPara("2", "1", "more"),
+			},
+			want: "<ol>\n<li>first<ol>\n<li>detail</li>\n<li>more</li>\n</ol>\n</li>\n</ol>\n",
+		},
+		{
+			name: "skipped level is opened inside an item",
+			paragraphs: []string{
+				docxListPara("1", "0", "one"),
+				docxListPara("1", "2", "deep"),
+				docxListPara("1", "0", "two"),
+			},
+			want: "<ul>\n<li>one<ul>\n<li style=\"list-style-type: none\">\n<ul>\n<li>deep</li>\n</ul>\n</li>\n</ul>\n</li>\n<li>two</li>\n</ul>\n",
+		},
+		{
+			name: "list starting below the first level",
+			paragraphs: []string{
+				docxListPara("1", "1", "indented"),
+			},
+			want: "<ul>\n<li style=\"list-style-type: none\">\n<ul>\n<li>indented</li>\n</ul>\n</li>\n</ul>\n",
+		},
+		{
+			name: "list ends at a paragraph",
+			paragraphs: []string{
+				docxListPara("1", "0", "item"),
+				docxPara("", docxRun("After.", "")),
+			},
+			want: "<ul>\n<li>item</li>\n</ul>\n<p>After.</p>\n",
+		},
+	}
+	for _, tt := range tests {
+		got := convertDocx(t, tt.paragraphs...)
+		if got != tt.want {
+			t.Errorf("%v: got\n%v\nwant\n%v", tt.name, got, tt.want)
+		}
+		if strings.Contains(got, "<ul>\n<ul>") || strings.Contains(got, "<ol>\n<ol>") {
+			t.Errorf("%v: list directly inside a list:\n%v", tt.name, got)
+		}
+	}
+}
+
+func TestDocxImages(t *testing.T) {
+	filename := writeDocx(t, "images.docx",
+		docxPara("Heading1", docxRun("Chart", "")),
+		docxPara("", docxImageRun),
+	)
+	opts := fullpageOptions{AssetPrefix: "hbasset:"}
+
+	opts.Assets = "inline"
+	item, err := doLoadDocx("fullpage", filename, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(item.Page.Content, `src="data:image/png;base64,`) {
+		t.Errorf("inline: no data URI in %v", item.Page.Content)
+	}
+	if !strings.Contains(item.Page.Content, `alt="A chart" width="100" height="50"`) {
+		t.Errorf("inline: alt text and size not kept in %v", item.Page.Content)
+	}
+
+	opts.InlineMax = 10
+	item, err = doLoadDocx("fullpage", filename, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(item.Page.Content, "src=") {
+		t.Errorf("over the inline limit: image still has a src in %v", item.Page.Content)
+	}
+	if !strings.Contains(item.Page.Content, `alt="A chart"`) {
+		t.Errorf("over the inline limit: alt text lost in %v", item.Page.Content)
+	}
+	if len(item.Warnings) != 1 || !strings.Contains(item.Warnings[0], "inline limit") {
+		t.Errorf("over the inline limit: warnings %q", item.Warnings)
+	}
+
+	opts.Assets = "upload"
+	item, err = doLoadDocx("fullpage", filename, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(item.Assets) != 1 || item.Assets[0].ContentType != "image/png" {
+		t.Fatalf("upload: assets %+v", item.Assets)
+	}
+	if !strings.Contains(item.Page.Content, `src="hbasset:`+item.Assets[0].ID+`"`) {
+		t.Errorf("upload: no asset reference in %v", item.Page.Content)
+	}
+	if len(item.Warnings) != 0 {
+		t.Errorf("upload: warnings %q", item.Warnings)
+	}
+}
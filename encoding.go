@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// metaCharset finds the encoding declared by <meta charset> or
+// <meta http-equiv="Content-Type" content="...; charset=...">.
+var metaCharset = regexp.MustCompile(`(?i)(<meta\b[^>]*?charset\s*=\s*["']?\s*)([\w.:-]+)`)
+
+// prescanLength is how far into a document the declaration is looked for,
+// as browsers do.
+const prescanLength = 1024
+
+// normalizers are the replacements applied by each -normalize option.
+var normalizers = map[string]*strings.Replacer{
+	"quotes": strings.NewReplacer(
+		"\u2018", "'", "\u2019", "'", "\u201a", "'", "\u201b", "'",
+		"\u201c", `"`, "\u201d", `"`, "\u201e", `"`, "\u201f", `"`,
+		"&lsquo;", "'", "&rsquo;", "'", "&ldquo;", `"`, "&rdquo;", `"`,
+	),
+	"nbsp": strings.NewReplacer("\u00a0", " ", "&nbsp;", " ", "&#160;", " ", "&#xa0;", " ", "&#xA0;", " "),
+}
+
+// decodeHTML returns data as UTF-8. The encoding is taken from a byte order
+// mark if there is one; otherwise data that is valid UTF-8 is taken as UTF-8,
+// whatever its <meta> says, and other data is decoded with the encoding its
+// <meta> declares, or Windows-1252 when it declares none or claims UTF-8.
+// A <meta> declaration is rewritten to utf-8. The options in normalize are
+// then applied. Every conversion and normalisation is reported as a warning.
+func decodeHTML(data []byte, normalize []string) (text string, warnings []string, err error) {
+	declared := ""
+	head := data
+	if len(head) > prescanLength {
+		head = head[:prescanLength]
+	}
+	if m := metaCharset.FindSubmatch(head); m != nil {
+		declared = strings.ToLower(string(m[2]))
+	}
+
+	var enc encoding.Encoding
+	var name string
+	switch {
+	case bytes.HasPrefix(data, []byte("\xef\xbb\xbf")):
+		data = data[3:]
+	case bytes.HasPrefix(data, []byte("\xff\xfe")):
+		enc, name = unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), "utf-16le"
+	case bytes.HasPrefix(data, []byte("\xfe\xff")):
+		enc, name = unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), "utf-16be"
+	case utf8.Valid(data):
+		if declared != "" && !isUTF8Label(declared) && !isASCII(data) {
+			warnings = append(warnings, fmt.Sprintf("charset: <meta> declares %v but the bytes are UTF-8; read as UTF-8", declared))
+		}
+	default:
+		if declared != "" && !isUTF8Label(declared) {
+			enc, name = charset.Lookup(declared)
+			if enc == nil {
+				warnings = append(warnings, fmt.Sprintf("charset: unknown encoding %q in <meta>", declared))
+			}
+		}
+		if enc == nil {
+			enc, name = charmap.Windows1252, "windows-1252"
+		}
+	}
+
+	if enc != nil {
+		data, err = enc.NewDecoder().Bytes(data)
+		if err != nil {
+			return
+		}
+		note := ""
+		if declared != "" && declared != name {
+			note = fmt.Sprintf(" (<meta> declares %v)", declared)
+		}
+		warnings = append(warnings, fmt.Sprintf("charset: converted from %v to UTF-8%v", name, note))
+	}
+
+	text = string(data)
+	if declared != "" && !isUTF8Label(declared) {
+		text = metaCharset.ReplaceAllString(text, "${1}utf-8")
+	}
+
+	for _, opt := range normalize {
+		r, ok := normalizers[opt]
+		if !ok {
+			err = fmt.Errorf("Not a valid normalize option: %v", opt)
+			return
+		}
+		normalized := replaceText(text, r)
+		if normalized != text {
+			warnings = append(warnings, fmt.Sprintf("charset: normalised %v", opt))
+			text = normalized
+		}
+	}
+	return
+}
+
+// replaceText applies r to the text of content, outside <script> and
+// <style>, leaving tags and attribute values as written.
+func replaceText(content string, r *strings.Replacer) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(content))
+	inRaw := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return b.String()
+		}
+		raw := string(z.Raw())
+		switch tt {
+		case html.TextToken:
+			if !inRaw {
+				raw = r.Replace(raw)
+			}
+		case html.StartTagToken, html.EndTagToken:
+			name, _ := z.TagName()
+			if string(name) == "script" || string(name) == "style" {
+				inRaw = tt == html.StartTagToken
+			}
+		}
+		b.WriteString(raw)
+	}
+}
+
+func isUTF8Label(label string) bool {
+	return label == "utf-8" || label == "utf8" || label == "unicode-1-1-utf-8"
+}
+
+func isASCII(data []byte) bool {
+	for _, b := range data {
+		if b >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
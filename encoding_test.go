@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestDecodeHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		text     string
+		warnings int
+	}{
+		{"utf-8", "<p>Fièvre</p>", "<p>Fièvre</p>", 0},
+		{"utf-8 bom", "\xef\xbb\xbf<p>Fièvre</p>", "<p>Fièvre</p>", 0},
+		{"utf-8 declared", `<meta charset="utf-8"><p>Fièvre</p>`, `<meta charset="utf-8"><p>Fièvre</p>`, 0},
+		{"ascii declared latin-1", `<meta charset="iso-8859-1"><p>x</p>`, `<meta charset="utf-8"><p>x</p>`, 0},
+		{"utf-8 declared latin-1", `<meta charset="iso-8859-1"><p>Fièvre</p>`, `<meta charset="utf-8"><p>Fièvre</p>`, 1},
+		{"latin-1 declared", "<meta charset=\"iso-8859-1\"><p>Fi\xe8vre</p>", `<meta charset="utf-8"><p>Fièvre</p>`, 1},
+		{"http-equiv", "<meta http-equiv=\"Content-Type\" content=\"text/html; charset=windows-1251\"><p>\xc4\xe0</p>",
+			`<meta http-equiv="Content-Type" content="text/html; charset=utf-8"><p>Да</p>`, 1},
+		{"undeclared", "<p>Fi\xe8vre \x93quoted\x94</p>", "<p>Fièvre “quoted”</p>", 1},
+		{"claims utf-8", "<meta charset=\"utf-8\"><p>Fi\xe8vre</p>", `<meta charset="utf-8"><p>Fièvre</p>`, 1},
+		{"unknown declared", "<meta charset=\"klingon\"><p>Fi\xe8vre</p>", `<meta charset="utf-8"><p>Fièvre</p>`, 2},
+		{"utf-16le", "\xff\xfe<\x00p\x00>\x00\xe8\x00", "<p>è", 1},
+		{"utf-16be", "\xfe\xff\x00<\x00p\x00>\x00\xe8", "<p>è", 1},
+	}
+	for _, tt := range tests {
+		text, warnings, err := decodeHTML([]byte(tt.data), nil)
+		if err != nil || text != tt.text || len(warnings) != tt.warnings {
+			t.Errorf("%v: decodeHTML() = %q, %q, %v; want %q, %v warnings", tt.name, text, warnings, err, tt.text, tt.warnings)
+		}
+	}
+}
+
+func TestDecodeHTMLNormalize(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		normalize []string
+		text      string
+		warnings  int
+	}{
+		{"quotes", "<p title=\"“q”\">“q” &lsquo;s&rsquo;</p>", []string{"quotes"}, "<p title=\"“q”\">\"q\" 's'</p>", 1},
+		{"nbsp", "<p>a\u00a0b&nbsp;c&#160;d</p>", []string{"nbsp"}, "<p>a b c d</p>", 1},
+		{"script and style", "<script>x=\"“\"</script><style>p{content:\"”\"}</style>", []string{"quotes"}, "<script>x=\"“\"</script><style>p{content:\"”\"}</style>", 0},
+		{"after script", "<script>x</script><p>“q”</p>", []string{"quotes"}, `<script>x</script><p>"q"</p>`, 1},
+		{"both", "<p>“a\u00a0b”</p>", []string{"quotes", "nbsp"}, `<p>"a b"</p>`, 2},
+	}
+	for _, tt := range tests {
+		text, warnings, err := decodeHTML([]byte(tt.data), tt.normalize)
+		if err != nil || text != tt.text || len(warnings) != tt.warnings {
+			t.Errorf("%v: decodeHTML() = %q, %q, %v; want %q, %v warnings", tt.name, text, warnings, err, tt.text, tt.warnings)
+		}
+	}
+
+	if _, _, err := decodeHTML([]byte("<p>x</p>"), []string{"dashes"}); err == nil {
+		t.Errorf("decodeHTML() with an unknown normalize option returned no error")
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"golang.org/x/net/html"
+)
+
+// xhtmlVoid are the elements written as empty-element tags.
+var xhtmlVoid = stringSet([]string{"area", "base", "br", "col", "embed", "hr", "img", "input", "link", "meta", "param", "source", "track", "wbr"})
+
+// epubDropped are left out of EPUB pages: scripts are not run by most
+// readers, and <noscript> and <base> are not allowed in XHTML documents.
+var epubDropped = stringSet([]string{"script", "noscript", "base"})
+
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+// xmlEscape escapes s for XML text and attribute values, dropping the
+// characters XML does not allow.
+func xmlEscape(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || (r >= 0x20 && r != 0xfffe && r != 0xffff) {
+			return r
+		}
+		return -1
+	}, s)
+	return xmlEscaper.Replace(s)
+}
+
+// epubItem is a file of the package listed in its manifest.
+type epubItem struct {
+	ID         string
+	Href       string
+	MediaType  string
+	Properties string
+	Data       []byte
+}
+
+// epubBuilder assembles one book as an EPUB 3 package.
+type epubBuilder struct {
+	content *exportContent
+	book    bookRecord
+	opts    fullpageOptions
+	lang    string
+	// files maps the ID of each page of the book to its file.
+	files    map[string]string
+	pages    []epubItem
+	assets   []epubItem
+	added    map[string]bool
+	sections map[string][]tocEntry
+	warnings []string
+}
+
+// writeEPUB writes book to filename as an EPUB 3 package: one XHTML file per
+// page, in book order, a navigation document made from the chapters and the
+// headings of each page, and the page's assets. Links to pages of the book
+// become links between its files; links to other pages are removed. lang is
+// the language of pages that do not declare one. Problems that leave the
+// package usable are returned as warnings.
+func writeEPUB(filename string, c *exportContent, book bookRecord, opts fullpageOptions, lang string, modified time.Time) (warnings []string, err error) {
+	b := &epubBuilder{
+		content:  c,
+		book:     book,
+		opts:     opts,
+		lang:     lang,
+		files:    map[string]string{},
+		added:    map[string]bool{},
+		sections: map[string][]tocEntry{},
+	}
+	ids := bookPages(book)
+	for i, id := range ids {
+		b.files[id] = fmt.Sprintf("page%d.xhtml", i+1)
+	}
+	for i, id := range ids {
+		fp, ok := c.pages[id]
+		if !ok {
+			return nil, fmt.Errorf("book %v: no Fullpage %v", book.ID, id)
+		}
+		var item epubItem
+		item, err = b.page(fp)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", id, err)
+		}
+		item.ID = fmt.Sprintf("page%d", i+1)
+		b.pages = append(b.pages, item)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	zw := zip.NewWriter(f)
+	// The mimetype comes first and uncompressed, so the file can be
+	// recognised from its first bytes.
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return
+	}
+	_, err = io.WriteString(w, "application/epub+zip")
+	if err != nil {
+		return
+	}
+
+	w, err = zw.CreateHeader(&zip.FileHeader{Name: "META-INF/container.xml", Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return
+	}
+	_, err = io.WriteString(w, epubContainer)
+	if err != nil {
+		return
+	}
+
+	files := []epubItem{
+		{Href: "content.opf", Data: b.packageDocument(modified)},
+		{Href: "nav.xhtml", Data: b.navDocument(ids)},
+	}
+	files = append(files, b.pages...)
+	files = append(files, b.assets...)
+	for _, item := range files {
+		w, err = zw.CreateHeader(&zip.FileHeader{Name: "OEBPS/" + item.Href, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return
+		}
+		_, err = w.Write(item.Data)
+		if err != nil {
+			return
+		}
+	}
+	err = zw.Close()
+	return b.warnings, err
+}
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+// page converts fp to an XHTML content document.
+func (b *epubBuilder) page(fp hb.Fullpage) (item epubItem, err error) {
+	doc, err := html.Parse(strings.NewReader(fp.Content))
+	if err != nil {
+		return
+	}
+	b.sections[fp.ID] = pageTOC(doc)
+
+	lang := b.lang
+	var head, body *html.Node
+	svg := false
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch {
+			case n.Data == "html" && htmlpage.Attr(n, "lang") != "":
+				lang = htmlpage.Attr(n, "lang")
+			case n.Data == "head":
+				head = n
+			case n.Data == "body":
+				body = n
+			case n.Data == "svg":
+				svg = true
+			case n.Data == "style" && n.FirstChild != nil && n.FirstChild.Type == html.TextNode:
+				n.FirstChild.Data = b.css(n.FirstChild.Data, "assets/")
+			}
+			b.rewriteAttrs(fp.ID, n)
+		}
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			if c.Type == html.ElementNode && epubDropped[c.Data] {
+				n.RemoveChild(c)
+			} else {
+				walk(c)
+			}
+			c = next
+		}
+	}
+	walk(doc)
+
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<!DOCTYPE html>\n<html xmlns=\"http://www.w3.org/1999/xhtml\" xmlns:epub=\"http://www.idpf.org/2007/ops\" lang=\"%v\" xml:lang=\"%v\">\n<head>\n<meta charset=\"utf-8\"/>\n<title>%v</title>\n",
+		xmlEscape(lang), xmlEscape(lang), xmlEscape(fp.Title))
+	if head != nil {
+		for c := head.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && (c.Data == "style" || (c.Data == "link" && hasToken(htmlpage.Attr(c, "rel"), "stylesheet"))) {
+				renderXHTML(&w, c)
+				w.WriteString("\n")
+			}
+		}
+	}
+	w.WriteString("</head>\n")
+	if body != nil {
+		renderXHTML(&w, body)
+	} else {
+		w.WriteString("<body></body>")
+	}
+	w.WriteString("\n</html>\n")
+
+	item = epubItem{Href: b.files[fp.ID], MediaType: "application/xhtml+xml", Data: w.Bytes()}
+	if svg {
+		item.Properties = "svg"
+	}
+	return
+}
+
+// rewriteAttrs points the page and asset references of n into the package,
+// and drops event handler attributes, whose scripts are gone.
+func (b *epubBuilder) rewriteAttrs(page string, n *html.Node) {
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		key := strings.ToLower(a.Key)
+		switch {
+		case strings.HasPrefix(key, "on"):
+			continue
+		case key == "style":
+			a.Val = b.css(a.Val, "assets/")
+		case key == "href" || key == "src" || key == "poster":
+			val := strings.TrimSpace(a.Val)
+			switch {
+			case b.opts.LinkPrefix != "" && strings.HasPrefix(val, b.opts.LinkPrefix):
+				id, frag := splitFragment(strings.TrimPrefix(val, b.opts.LinkPrefix))
+				file, ok := b.files[id]
+				if !ok {
+					b.warnings = append(b.warnings, fmt.Sprintf("%v: link to %v, which is not in the book, removed", page, id))
+					continue
+				}
+				a.Val = file + frag
+			case b.opts.AssetPrefix != "" && strings.HasPrefix(val, b.opts.AssetPrefix):
+				href, ok := b.asset(page, strings.TrimPrefix(val, b.opts.AssetPrefix))
+				if !ok {
+					continue
+				}
+				a.Val = "assets/" + href
+			case strings.HasPrefix(val, "data:") && key != "href":
+				href, ok := b.dataAsset(page, val)
+				if !ok {
+					continue
+				}
+				a.Val = "assets/" + href
+			case key != "href" && (strings.HasPrefix(val, "http:") || strings.HasPrefix(val, "https:") || strings.HasPrefix(val, "//")):
+				b.warnings = append(b.warnings, fmt.Sprintf("%v: remote %v %v is not embedded", page, n.Data, val))
+			}
+		}
+		attrs = append(attrs, a)
+	}
+	n.Attr = attrs
+}
+
+// splitFragment splits "id#fragment" into the ID and "#fragment".
+func splitFragment(ref string) (id string, frag string) {
+	if i := strings.Index(ref, "#"); i >= 0 {
+		return ref[:i], ref[i:]
+	}
+	return ref, ""
+}
+
+// css points the asset references in css into the package. base is the
+// path of the assets directory from the file the CSS is in.
+func (b *epubBuilder) css(css string, base string) string {
+	return cssURL.ReplaceAllStringFunc(css, func(m string) string {
+		ref := cssURL.FindStringSubmatch(m)[2]
+		var href string
+		var ok bool
+		switch {
+		case b.opts.AssetPrefix != "" && strings.HasPrefix(ref, b.opts.AssetPrefix):
+			href, ok = b.asset("stylesheet", strings.TrimPrefix(ref, b.opts.AssetPrefix))
+		case strings.HasPrefix(ref, "data:"):
+			href, ok = b.dataAsset("stylesheet", ref)
+		}
+		if !ok {
+			return m
+		}
+		return `url("` + base + href + `")`
+	})
+}
+
+// asset adds the asset id to the package, once, and returns its file name in
+// the assets directory.
+func (b *epubBuilder) asset(page string, id string) (string, bool) {
+	if b.added[id] {
+		return id, true
+	}
+	a, data, err := b.content.asset(id)
+	if err != nil {
+		b.warnings = append(b.warnings, fmt.Sprintf("%v: asset %v: %v", page, id, err))
+		return "", false
+	}
+	b.addAsset(id, a.ContentType, data)
+	return id, true
+}
+
+// dataAsset adds the content of a data: URI to the package as a file.
+func (b *epubBuilder) dataAsset(page string, uri string) (string, bool) {
+	contentType, data, err := decodeDataURI(uri)
+	if err != nil {
+		b.warnings = append(b.warnings, fmt.Sprintf("%v: %v", page, err))
+		return "", false
+	}
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:8])
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+		name += exts[0]
+	}
+	if !b.added[name] {
+		b.addAsset(name, contentType, data)
+	}
+	return name, true
+}
+
+func (b *epubBuilder) addAsset(name string, contentType string, data []byte) {
+	b.added[name] = true
+	if contentType == "" {
+		contentType = assetContentType(name, data)
+	}
+	if contentType == "text/css" {
+		data = []byte(b.css(string(data), ""))
+	}
+	b.assets = append(b.assets, epubItem{
+		ID:        fmt.Sprintf("asset%d", len(b.assets)+1),
+		Href:      "assets/" + name,
+		MediaType: contentType,
+		Data:      data,
+	})
+}
+
+// decodeDataURI returns the content type and data of a data: URI.
+func decodeDataURI(uri string) (contentType string, data []byte, err error) {
+	comma := strings.Index(uri, ",")
+	if comma < 0 {
+		return "", nil, fmt.Errorf("data URI without data")
+	}
+	params := strings.Split(uri[len("data:"):comma], ";")
+	contentType = params[0]
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	if params[len(params)-1] == "base64" {
+		data, err = base64.StdEncoding.DecodeString(uri[comma+1:])
+		return
+	}
+	s, err := url.PathUnescape(uri[comma+1:])
+	return contentType, []byte(s), err
+}
+
+// navDocument returns the navigation document: a chapter per titled chapter
+// of the book, holding its pages, and under each page its headings. Pages
+// of an untitled chapter are listed at the top level.
+func (b *epubBuilder) navDocument(ids []string) []byte {
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<!DOCTYPE html>\n<html xmlns=\"http://www.w3.org/1999/xhtml\" xmlns:epub=\"http://www.idpf.org/2007/ops\" lang=\"%v\" xml:lang=\"%v\">\n<head>\n<meta charset=\"utf-8\"/>\n<title>%v</title>\n</head>\n<body>\n<nav epub:type=\"toc\" id=\"toc\">\n<h1>Contents</h1>\n<ol>\n",
+		xmlEscape(b.lang), xmlEscape(b.lang), xmlEscape(b.book.Title))
+	listed := map[string]bool{}
+	for _, ch := range b.book.Chapters {
+		var pages []string
+		for _, id := range ch.Pages {
+			if !listed[id] {
+				listed[id] = true
+				pages = append(pages, id)
+			}
+		}
+		if len(pages) == 0 {
+			continue
+		}
+		if ch.Title != "" {
+			fmt.Fprintf(&w, "<li><span>%v</span>\n<ol>\n", xmlEscape(ch.Title))
+		}
+		for _, id := range pages {
+			title := b.content.pages[id].Title
+			if title == "" {
+				title = id
+			}
+			fmt.Fprintf(&w, "<li><a href=\"%v\">%v</a>", xmlEscape(b.files[id]), xmlEscape(title))
+			b.navEntries(&w, b.files[id], b.sections[id])
+			w.WriteString("</li>\n")
+		}
+		if ch.Title != "" {
+			w.WriteString("</ol></li>\n")
+		}
+	}
+	w.WriteString("</ol>\n</nav>\n</body>\n</html>\n")
+	return w.Bytes()
+}
+
+func (b *epubBuilder) navEntries(w *bytes.Buffer, file string, entries []tocEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	w.WriteString("\n<ol>\n")
+	for _, e := range entries {
+		href := file
+		if e.Anchor != "" {
+			href += "#" + e.Anchor
+		}
+		fmt.Fprintf(w, "<li><a href=\"%v\">%v</a>", xmlEscape(href), xmlEscape(e.Title))
+		b.navEntries(w, file, e.Children)
+		w.WriteString("</li>\n")
+	}
+	w.WriteString("</ol>\n")
+}
+
+// packageDocument returns the package document: the book's metadata, the
+// manifest of every file and the reading order. The identifier is derived
+// from the book ID, so it stays the same from one export to the next.
+func (b *epubBuilder) packageDocument(modified time.Time) []byte {
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<package xmlns=\"http://www.idpf.org/2007/opf\" version=\"3.0\" unique-identifier=\"bookid\" xml:lang=\"%v\">\n", xmlEscape(b.lang))
+	w.WriteString("<metadata xmlns:dc=\"http://purl.org/dc/elements/1.1/\">\n")
+	fmt.Fprintf(&w, "<dc:identifier id=\"bookid\">urn:uuid:%v</dc:identifier>\n", bookUUID(b.book.ID))
+	title := b.book.Title
+	if title == "" {
+		title = b.book.ID
+	}
+	fmt.Fprintf(&w, "<dc:title>%v</dc:title>\n", xmlEscape(title))
+	fmt.Fprintf(&w, "<dc:language>%v</dc:language>\n", xmlEscape(b.lang))
+	seen := map[string]bool{}
+	for _, id := range bookPages(b.book) {
+		if author := b.content.authors[id]; author != "" && !seen[author] {
+			seen[author] = true
+			fmt.Fprintf(&w, "<dc:creator>%v</dc:creator>\n", xmlEscape(author))
+		}
+	}
+	if b.book.HandbookType != "" {
+		fmt.Fprintf(&w, "<dc:subject>%v</dc:subject>\n", xmlEscape(b.book.HandbookType))
+	}
+	if b.opts.BuildDate != "" {
+		fmt.Fprintf(&w, "<dc:date>%v</dc:date>\n", xmlEscape(b.opts.BuildDate))
+	}
+	fmt.Fprintf(&w, "<meta property=\"dcterms:modified\">%v</meta>\n", modified.UTC().Format("2006-01-02T15:04:05Z"))
+	w.WriteString("</metadata>\n<manifest>\n")
+	w.WriteString("<item id=\"nav\" href=\"nav.xhtml\" media-type=\"application/xhtml+xml\" properties=\"nav\"/>\n")
+	for _, items := range [][]epubItem{b.pages, b.assets} {
+		for _, item := range items {
+			props := ""
+			if item.Properties != "" {
+				props = fmt.Sprintf(" properties=\"%v\"", item.Properties)
+			}
+			fmt.Fprintf(&w, "<item id=\"%v\" href=\"%v\" media-type=\"%v\"%v/>\n", item.ID, xmlEscape(item.Href), xmlEscape(item.MediaType), props)
+		}
+	}
+	w.WriteString("</manifest>\n<spine>\n")
+	for _, item := range b.pages {
+		fmt.Fprintf(&w, "<itemref idref=\"%v\"/>\n", item.ID)
+	}
+	w.WriteString("</spine>\n</package>\n")
+	return w.Bytes()
+}
+
+// bookUUID returns a name-based (version 5 style) UUID for a book ID.
+func bookUUID(id string) string {
+	sum := sha1.Sum([]byte("hbctrl:book:" + id))
+	u := sum[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// renderXHTML writes n in the XML syntax of HTML: every element closed,
+// empty elements as empty-element tags, and SVG and MathML with their
+// namespaces declared. Comments and attributes whose names are not XML
+// names are left out.
+func renderXHTML(w *bytes.Buffer, n *html.Node) {
+	switch n.Type {
+	case html.DocumentNode:
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			renderXHTML(w, c)
+		}
+	case html.TextNode:
+		w.WriteString(xmlEscape(n.Data))
+	case html.ElementNode:
+		w.WriteString("<" + n.Data)
+		if n.Parent == nil || n.Parent.Namespace != n.Namespace {
+			switch n.Namespace {
+			case "svg":
+				w.WriteString(` xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"`)
+			case "math":
+				w.WriteString(` xmlns="http://www.w3.org/1998/Math/MathML"`)
+			}
+		}
+		for _, a := range n.Attr {
+			key := a.Key
+			switch a.Namespace {
+			case "xlink", "xml":
+				key = a.Namespace + ":" + key
+			case "xmlns":
+				continue
+			}
+			if key == "xmlns" || strings.HasPrefix(key, "xmlns:") || !isXMLName(key) {
+				continue
+			}
+			fmt.Fprintf(w, " %v=\"%v\"", key, xmlEscape(a.Val))
+		}
+		if n.FirstChild == nil && (xhtmlVoid[n.Data] || n.Namespace != "") {
+			w.WriteString("/>")
+			return
+		}
+		w.WriteString(">")
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			renderXHTML(w, c)
+		}
+		w.WriteString("</" + n.Data + ">")
+	}
+}
+
+func isXMLName(s string) bool {
+	for i, r := range s {
+		switch {
+		case r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r > 0x7f:
+		case i > 0 && (r == '-' || r == '.' || (r >= '0' && r <= '9')):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+)
+
+// exportContent is what an export is made from: the Fullpages, books and
+// assets of a local load or of the server tables.
+type exportContent struct {
+	pages  map[string]hb.Fullpage
+	books  []bookRecord
+	assets map[string]asset
+	// authors holds the author metadata of the pages that have it.
+	authors map[string]string
+	// fetch, when set, gets an asset that is not in assets.
+	fetch func(id string) (asset, error)
+}
+
+// contentFromItems returns the Fullpages and assets of a load.
+func contentFromItems(items []loadItem) (c *exportContent, err error) {
+	c = &exportContent{pages: map[string]hb.Fullpage{}, assets: map[string]asset{}, authors: map[string]string{}}
+	for _, item := range items {
+		var fp *hb.Fullpage
+		fp, err = item.page()
+		if err != nil {
+			return
+		}
+		if fp == nil {
+			continue
+		}
+		c.pages[fp.ID] = *fp
+		for _, a := range item.Assets {
+			c.assets[a.ID] = a
+		}
+		if item.Metadata != nil && item.Metadata.Author != "" {
+			c.authors[fp.ID] = item.Metadata.Author
+		}
+	}
+	return
+}
+
+// serverContent returns the live Fullpages of the server. Assets are
+// fetched as the export asks for them. The book table does not hold the
+// books' chapters, so the books come from -books or -toc.
+func serverContent(ctx context.Context) (c *exportContent, err error) {
+	c = &exportContent{pages: map[string]hb.Fullpage{}, assets: map[string]asset{}, authors: map[string]string{}}
+	tableURL, err := doGetLoadURL("fullpage")
+	if err != nil {
+		return
+	}
+	rows, err := serverRows(ctx, tableURL)
+	if err != nil {
+		return nil, fmt.Errorf("fullpage: %v", err)
+	}
+	for _, r := range rows {
+		var fp hb.Fullpage
+		err = json.Unmarshal(r, &fp)
+		if err != nil {
+			return nil, fmt.Errorf("fullpage: %v", err)
+		}
+		if !strings.HasPrefix(fp.ID, draftPrefix) {
+			c.pages[fp.ID] = fp
+		}
+	}
+
+	assetURL, err := doGetLoadURL("asset")
+	if err != nil {
+		return
+	}
+	c.fetch = func(id string) (a asset, err error) {
+		payload, err := apiGet(ctx, assetURL+url.PathEscape(id))
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(payload, &a)
+		return
+	}
+	return
+}
+
+// asset returns the asset id and its decoded data.
+func (c *exportContent) asset(id string) (a asset, data []byte, err error) {
+	a, ok := c.assets[id]
+	if !ok {
+		if c.fetch == nil {
+			return a, nil, fmt.Errorf("no asset %v", id)
+		}
+		a, err = c.fetch(id)
+		if err != nil {
+			return
+		}
+		c.assets[id] = a
+	}
+	data, err = base64.StdEncoding.DecodeString(a.Data)
+	return
+}
+
+// readBooks reads the books in the JSON files at path, a file or a
+// directory.
+func readBooks(path string) (books []bookRecord, err error) {
+	err = eachJSONFile(path, func(name string, data []byte) error {
+		list, err := decodeBooks(data)
+		books = append(books, list...)
+		return err
+	})
+	return
+}
+
+// exportBooks returns the book with ID id, or every book when id is "".
+func exportBooks(books []bookRecord, id string) ([]bookRecord, error) {
+	if id == "" {
+		if len(books) == 0 {
+			return nil, fmt.Errorf("no books to export")
+		}
+		return books, nil
+	}
+	for _, b := range books {
+		if b.ID == id {
+			return []bookRecord{b}, nil
+		}
+	}
+	return nil, fmt.Errorf("no book %v", id)
+}
+
+// bookPages returns the IDs of the pages of b in reading order, each once.
+func bookPages(b bookRecord) (ids []string) {
+	seen := map[string]bool{}
+	for _, ch := range b.Chapters {
+		for _, id := range ch.Pages {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return
+}
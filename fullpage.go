@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"github.com/rstanleyhum/hbctrl/internal/itemid"
+)
+
+// fullpageOptions configures how an HTML file is turned into a hb.Fullpage.
+type fullpageOptions struct {
+	// DefaultTitle is used when a page has neither a <title> nor an <h1>.
+	DefaultTitle string
+	// IDStrategy is how the Fullpage ID is derived: "ext" strips the file
+	// extension, "slug" also slugifies the name, "meta" reads
+	// <meta name="hb-id"> and "map" looks the file up in IDMap.
+	IDStrategy string
+	IDMap      map[string]string
+	// Sanitize is "off", "report" or "enforce"; see sanitizeFullpage.
+	Sanitize string
+	Policy   sanitizePolicy
+	// Assets is "off", "inline" or "upload"; see bundleAssets. InlineMax is
+	// the largest file, in bytes, that is inlined as a data URI.
+	Assets      string
+	InlineMax   int64
+	AssetPrefix string
+	// Root is the load directory; asset references starting with "/" are
+	// resolved against it.
+	Root string
+	// Links is "off", "warn" or "fail"; see linkPages.
+	Links      string
+	LinkPrefix string
+	// Metadata is "off", "inline" or "table"; see loadItem.Metadata.
+	// MetaFields are the <meta> names and front matter keys extracted, and
+	// MetaRequired those that every page must have.
+	Metadata     string
+	MetaFields   []string
+	MetaRequired []string
+	// MarkdownTemplate wraps the HTML converted from Markdown sources.
+	MarkdownTemplate *template.Template
+	// Layouts, when set, wraps HTML body fragments; see wrapFragment.
+	// HandbookType and BuildDate are passed to the layout.
+	Layouts      *layoutSet
+	HandbookType string
+	BuildDate    string
+	// Normalize lists the decodeHTML replacements applied: "quotes" and
+	// "nbsp".
+	Normalize []string
+	// Split is "off", "h1" or "h2"; see splitPages.
+	Split string
+	// Headings is "off", "anchor" or "toc"; see headingPages.
+	Headings string
+	// Minify runs minifyPages once every other pass is done.
+	Minify bool
+}
+
+// printWarnings logs the validation warnings raised for one input file.
+func printWarnings(filename string, warnings []string) {
+	for _, w := range warnings {
+		log.Printf("Warning: %v: %v\n", filename, w)
+	}
+}
+
+// printErrors logs the errors raised for one input file and returns how
+// many there were.
+func printErrors(filename string, errs []string) int {
+	for _, e := range errs {
+		log.Printf("Error: %v: %v\n", filename, e)
+	}
+	return len(errs)
+}
+
+// sendItem sends an item's assets, the item itself and its metadata. sent
+// records the IDs of the assets already sent.
+func sendItem(ctx context.Context, url string, item loadItem, sent map[string]bool) (err error) {
+	js, err := item.payload()
+	if err != nil {
+		return
+	}
+	err = sendAssets(ctx, item.Assets, sent)
+	if err != nil {
+		return
+	}
+	err = apiUpsert(ctx, url, js)
+	if err != nil {
+		return
+	}
+	if item.Metadata != nil && item.MetadataMode == "table" {
+		err = sendMetadata(ctx, item.Metadata)
+	}
+	return
+}
+
+// fullpageItem runs the Fullpage pipeline over the HTML content of filename:
+// title extraction, metadata, sanitising and asset bundling. fields are the
+// file's front matter.
+func fullpageItem(filename string, id string, content string, fields map[string]string, opts fullpageOptions) (item loadItem, err error) {
+	item.Name = filepath.Base(filename)
+
+	var fp hb.Fullpage
+	fp, item.Warnings, err = htmlpage.Fullpage(id, content, opts.pageOptions())
+	if err != nil {
+		return
+	}
+	item.ID = fp.ID
+
+	switch opts.Metadata {
+	case "", "off":
+	case "inline", "table":
+		item.Metadata, item.Errors, err = extractMetadata(fp, fields, opts)
+		if err != nil {
+			return
+		}
+		item.MetadataMode = opts.Metadata
+	default:
+		err = fmt.Errorf("Not a valid metadata mode: %v", opts.Metadata)
+		return
+	}
+
+	var warnings []string
+	warnings, err = sanitizeFullpage(&fp, opts)
+	if err != nil {
+		return
+	}
+	item.Warnings = append(item.Warnings, warnings...)
+
+	item.Assets, warnings, err = bundleAssets(&fp, filepath.Dir(filename), opts)
+	if err != nil {
+		return
+	}
+	item.Warnings = append(item.Warnings, warnings...)
+	item.Page = &fp
+	return
+}
+
+// loadItem is one input file converted into the payload that is sent.
+type loadItem struct {
+	// Name is the slash-separated path of the file within the load
+	// directory.
+	Name string
+	// Source is the Name of the file a split page came from.
+	Source string
+	// ID is the item's ID when it is known before sending.
+	ID string
+	// Page is set for Fullpages, which stay unmarshalled until the passes
+	// over the whole load have run. Other items carry their payload in JS.
+	Page     *hb.Fullpage
+	JS       string
+	Warnings []string
+	// Errors stop the whole load before anything is sent.
+	Errors []string
+	// Assets must be sent before the item itself.
+	Assets []asset
+	// Metadata is sent inside the page payload when MetadataMode is
+	// "inline", and to the metadata table after the page when it is "table".
+	Metadata     *pageMetadata
+	MetadataMode string
+}
+
+// page returns the item's Fullpage, decoding the payload of Fullpages
+// loaded from JSON. It returns nil for an item with no payload.
+func (item loadItem) page() (fp *hb.Fullpage, err error) {
+	if item.Page != nil || item.JS == "" {
+		return item.Page, nil
+	}
+	fp = &hb.Fullpage{}
+	err = json.Unmarshal([]byte(item.JS), fp)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", item.Name, err)
+	}
+	return
+}
+
+// source returns the name of the file the item was loaded from.
+func (item loadItem) source() string {
+	if item.Source != "" {
+		return item.Source
+	}
+	return item.Name
+}
+
+// payload returns the JSON that is sent for the item.
+func (item loadItem) payload() (js string, err error) {
+	if item.Page == nil {
+		return item.JS, nil
+	}
+	var data []byte
+	if item.Metadata != nil && item.MetadataMode == "inline" {
+		data, err = json.Marshal(fullpageWithMetadata{Fullpage: *item.Page, Metadata: item.Metadata})
+	} else {
+		data, err = json.Marshal(item.Page)
+	}
+	if err != nil {
+		return
+	}
+	return string(data), nil
+}
+
+// inputExtensions lists the file extensions loaded for each input type.
+// Other files, such as images and stylesheets next to the pages, are
+// skipped.
+var inputExtensions = map[string][]string{
+	"html":     {".html", ".htm", ".xhtml"},
+	"markdown": {".md", ".markdown"},
+	"json":     {".json"},
+	"docx":     {".docx"},
+}
+
+// loadDir converts every input file under dir, skipping hidden files and
+// directories, then runs the passes that need the whole set of pages. Items
+// are returned even when a pass fails, so their warnings can be reported.
+func loadDir(dir string, table string, intype string, opts fullpageOptions) (items []loadItem, err error) {
+	exts, ok := inputExtensions[intype]
+	if !ok {
+		return nil, fmt.Errorf("Not a valid intype: %v", intype)
+	}
+
+	err = filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filename != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Word keeps a "~$" lock file beside an open document.
+		if info.IsDir() || !hasExtension(info.Name(), exts) || strings.HasPrefix(info.Name(), "~$") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+		item, err := loadFile(table, intype, filename, opts)
+		if err != nil {
+			return fmt.Errorf("%v: %v", rel, err)
+		}
+		item.Name = filepath.ToSlash(rel)
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items, err = splitPages(items, opts)
+	if err != nil {
+		return
+	}
+
+	err = headingPages(items, opts)
+	if err != nil {
+		return
+	}
+
+	err = linkPages(items, opts)
+	if err != nil {
+		return
+	}
+
+	if opts.Minify {
+		err = minifyPages(items, os.Stdout)
+	}
+	return
+}
+
+func hasExtension(name string, exts []string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// pageOptions returns the options htmlpage reads a page with.
+func (opts fullpageOptions) pageOptions() htmlpage.Options {
+	return htmlpage.Options{DefaultTitle: opts.DefaultTitle, MetaID: opts.IDStrategy == "meta"}
+}
+
+// fullpageID derives a Fullpage ID from a file name according to
+// opts.IDStrategy. The "meta" strategy starts from the "ext" ID and is
+// overridden by htmlpage.Fullpage when the page has an hb-id meta tag.
+func fullpageID(name string, opts fullpageOptions) (id string, err error) {
+	strategy := opts.IDStrategy
+	if strategy == "meta" {
+		strategy = "ext"
+	}
+	return itemid.FromName(name, strategy, opts.IDMap)
+}
+
+// duplicateIDs describes every ID that more than one item of a load maps to.
+func duplicateIDs(items []loadItem) (dups []string) {
+	ids := make([]string, len(items))
+	names := make([]string, len(items))
+	for i, item := range items {
+		ids[i], names[i] = item.ID, item.Name
+	}
+	return itemid.Duplicates(ids, names)
+}
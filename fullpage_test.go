@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFullpageID(t *testing.T) {
+	idmap := map[string]string{"asthma.html": "A001", "croup": "C002"}
+	tests := []struct {
+		name     string
+		strategy string
+		want     string
+		err      bool
+	}{
+		{"asthma.html", "", "asthma", false},
+		{"Asthma In Children.html", "ext", "Asthma In Children", false},
+		{"asthma.html", "meta", "asthma", false},
+		{"Asthma In Children.html", "slug", "asthma-in-children", false},
+		{"asthma.html", "map", "A001", false},
+		{"croup.html", "map", "C002", false},
+		{"otitis.html", "map", "", true},
+		{"---.html", "slug", "", true},
+		{".html", "ext", "", true},
+		{"asthma.html", "guess", "", true},
+	}
+	for _, tt := range tests {
+		opts := fullpageOptions{IDStrategy: tt.strategy, IDMap: idmap}
+		got, err := fullpageID(tt.name, opts)
+		if (err != nil) != tt.err {
+			t.Errorf("fullpageID(%q, %q) error = %v, want error %v", tt.name, tt.strategy, err, tt.err)
+			continue
+		}
+		if !tt.err && got != tt.want {
+			t.Errorf("fullpageID(%q, %q) = %q, want %q", tt.name, tt.strategy, got, tt.want)
+		}
+	}
+}
+
+func TestDuplicateIDs(t *testing.T) {
+	items := []loadItem{
+		{Name: "b.html", ID: "b"},
+		{Name: "a.html", ID: "a"},
+		{Name: "A.htm", ID: "a"},
+		{Name: "empty.html"},
+		{Name: "also-empty.html"},
+		{Name: "b.md", ID: "b"},
+		{Name: "c.html", ID: "c"},
+		{Name: "a.md", ID: "a"},
+	}
+	want := []string{"b from b.html, b.md", "a from a.html, A.htm, a.md"}
+	if got := duplicateIDs(items); !reflect.DeepEqual(got, want) {
+		t.Errorf("duplicateIDs() = %q, want %q", got, want)
+	}
+	if got := duplicateIDs(items[:2]); got != nil {
+		t.Errorf("duplicateIDs() of distinct IDs = %q, want none", got)
+	}
+}
@@ -2,20 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	hb "github.com/rstanleyhum/handbookappdb"
-	"golang.org/x/net/html"
+	"github.com/rstanleyhum/hbctrl/internal/itemid"
+	"github.com/rstanleyhum/hbctrl/internal/run"
 )
 
 func main() {
@@ -24,6 +29,44 @@ func main() {
 	filename := flag.String("infile", "", "Input Filename")
 	indir := flag.Bool("indir", false, "Is Directory flag")
 	intype := flag.String("intype", "html", "Input Filename Type")
+	defaultTitle := flag.String("default-title", "", "Title for pages without a <title> or <h1>")
+	idStrategy := flag.String("id", "ext", "Fullpage ID strategy: ext, slug, meta or map")
+	idMapFile := flag.String("idmap", "", "JSON file mapping file names to Fullpage IDs (for -id map)")
+	sanitize := flag.String("sanitize", "report", "HTML sanitiser mode: off, report or enforce")
+	policyFile := flag.String("policy", "", "JSON sanitiser policy (default built-in allowlist)")
+	assets := flag.String("assets", "off", "Local images and stylesheets: off, inline or upload")
+	inlineMax := flag.Int64("inline-max", 256*1024, "Largest asset in bytes to inline as a data URI")
+	assetPrefix := flag.String("asset-prefix", "hbasset:", "Reference prefix for uploaded assets")
+	links := flag.String("links", "warn", "Cross-page link check for directory loads: off, warn or fail")
+	linkPrefix := flag.String("link-prefix", "hbpage:", "Link prefix the app resolves to a Fullpage ID")
+	metadata := flag.String("metadata", "off", "Page metadata: off, inline (in the Fullpage payload) or table")
+	metaFields := flag.String("meta-fields", "description,keywords,section,last-reviewed,author", "Comma-separated <meta> names and front matter keys to extract")
+	metaRequired := flag.String("meta-required", "", "Comma-separated metadata fields every page must have")
+	mdTemplate := flag.String("md-template", "", "HTML template wrapping Markdown pages (default built-in)")
+	normalize := flag.String("normalize", "", "Comma-separated text normalisations: quotes (smart quotes), nbsp (non-breaking spaces)")
+	layout := flag.String("layout", "", "Layout template, or directory of <name>.html layouts, wrapping HTML body fragments")
+	handbookType := flag.String("handbook-type", "", "Handbook type passed to layouts and used to choose one")
+	split := flag.String("split", "off", "Split pages into several Fullpages at headings: off, h1 or h2 (h1 and h2)")
+	headings := flag.String("headings", "off", "Heading anchors: off, anchor (add missing ids) or toc (also embed a contents list)")
+	minify := flag.Bool("minify", false, "Minify Fullpage HTML before upload")
+	statefile := flag.String("state", "hbctrl.state", "State file for resuming a directory load")
+	quiet := flag.Bool("quiet", false, "Do not show progress")
+	outfile := flag.String("outfile", "searchindex.json", "Output file for index build")
+	upload := flag.Bool("upload", false, "Upload what index build or book build produces")
+	toc := flag.String("toc", "", "Table of contents (YAML or Markdown outline) for book build (default: directory layout)")
+	outdir := flag.String("outdir", "books", "Output directory for book build, export and pull")
+	bookID := flag.String("book", "", "Book to export as EPUB (default: every book)")
+	lang := flag.String("lang", "en", "Language of exported pages that do not declare one")
+	addr := flag.String("addr", "localhost:8080", "Address the preview server listens on")
+	books := flag.String("books", "", "Book JSON file or directory for the preview sidebar, check and export")
+	messages := flag.String("messages", "", "Update message JSON file or directory for check")
+	server := flag.Bool("server", false, "Check the server tables as well as local content, or export the server's pages")
+	draft := flag.Bool("draft", false, "Upload into the draft namespace, to go live with -cmd publish")
+	filter := flag.String("filter", "", "OData $filter expression selecting the items to pull")
+	since := flag.String("since", "", "Pull items changed since an RFC 3339 time, or \"last\" for since the previous pull")
+	releases := flag.String("releases", "hbctrl.releases", "Log of publishes, for -cmd rollback")
+	changed := flag.String("changed", "off", "Skip unchanged items of a directory load: off, manifest or server")
+	manifestFile := flag.String("manifest", "hbctrl.manifest", "Content hashes of items sent (for -changed manifest)")
 	flag.Parse()
 
 	fmt.Println("command: ", *commandPtr)
@@ -31,80 +74,527 @@ func main() {
 	fmt.Println("infile:  ", *filename)
 	fmt.Println("intype:  ", *intype)
 	fmt.Println("indir:   ", *indir)
+	fmt.Println("state:   ", *statefile)
 
-	if !*indir && !isInFile(*filename) {
-		log.Fatalln("Not a valid filename")
+	if *filename != "" || !serverCommands[*commandPtr] {
+		if !*indir && !isInFile(*filename) {
+			log.Fatalln("Not a valid filename")
+		}
+
+		if *indir && !isInFileDirectory(*filename) {
+			log.Fatalln("Not a valid directory")
+		}
 	}
 
-	if *indir && !isInFileDirectory(*filename) {
-		log.Fatalln("Not a valid directory")
+	stop, abort, release := run.InterruptContexts()
+	defer release()
+
+	var err error
+
+	opts := fullpageOptions{
+		DefaultTitle: *defaultTitle,
+		IDStrategy:   *idStrategy,
+		Sanitize:     *sanitize,
+		Policy:       defaultSanitizePolicy,
+		Assets:       *assets,
+		InlineMax:    *inlineMax,
+		AssetPrefix:  *assetPrefix,
+		Root:         *filename,
+		Links:        *links,
+		LinkPrefix:   *linkPrefix,
+		Metadata:     *metadata,
+		MetaFields:   splitList(*metaFields),
+		MetaRequired: splitList(*metaRequired),
+		HandbookType: *handbookType,
+		BuildDate:    time.Now().Format("2006-01-02"),
+		Normalize:    splitList(*normalize),
+		Split:        *split,
+		Headings:     *headings,
+		Minify:       *minify,
+	}
+	if !*indir {
+		opts.Root = filepath.Dir(*filename)
+	}
+	if *idMapFile != "" {
+		idmap, err := itemid.ReadMap(*idMapFile)
+		if err != nil {
+			log.Fatalf("Cannot read ID map: %v\n", err)
+		}
+		opts.IDMap = idmap
+	}
+	opts.MarkdownTemplate, err = readMarkdownTemplate(*mdTemplate)
+	if err != nil {
+		log.Fatalf("Cannot read Markdown template: %v\n", err)
+	}
+	if *layout != "" {
+		opts.Layouts, err = readLayouts(*layout)
+		if err != nil {
+			log.Fatalf("Cannot read layout: %v\n", err)
+		}
+	}
+	if *policyFile != "" {
+		policy, err := readSanitizePolicy(*policyFile)
+		if err != nil {
+			log.Fatalf("Cannot read sanitiser policy: %v\n", err)
+		}
+		opts.Policy = policy
+	}
+
+	if *draft && *commandPtr == "load" && !isPublishTable(*tablePtr) {
+		log.Fatalf("Table %v has no drafts\n", *tablePtr)
 	}
 
 	var url string
-	var js string
-	var method string
-	var err error
 
 	switch {
 	case !*indir && *commandPtr == "load":
-		method = "POST"
 		url, err = doGetLoadURL(*tablePtr)
 		if err != nil {
 			log.Fatalf("Not valid URL for table: %v\n", *tablePtr)
 		}
 
-		switch *intype {
-		case "html":
-			js, err = doLoadHTML(*tablePtr, *filename)
-		case "json":
-			js, err = doLoadJSON(*tablePtr, *filename)
-		default:
-			log.Fatalf("No a valid input filename type: %v\n", *intype)
+		item, err := loadFile(*tablePtr, *intype, *filename, opts)
+		items := []loadItem{item}
+		if err == nil {
+			items, err = splitPages(items, opts)
+		}
+		if err == nil {
+			err = headingPages(items, opts)
+		}
+		if err == nil && opts.Minify {
+			err = minifyPages(items, os.Stdout)
+		}
+		if err == nil && *draft {
+			err = draftItems(items)
 		}
 		if err != nil {
+			log.Fatalf("Not valid payload from file: %v: %v\n", *filename, err)
+		}
+		errs := 0
+		for _, item := range items {
+			printWarnings(item.Name, item.Warnings)
+			errs += printErrors(item.Name, item.Errors)
+		}
+		if errs > 0 {
 			log.Fatalf("Not valid payload from file: %v\n", *filename)
 		}
-		err = apiSend(url, method, js)
-		if err != nil {
-			log.Fatalf("apiSend Error: %v", err)
+		sent := map[string]bool{}
+		for _, item := range items {
+			err = sendItem(abort, url, item, sent)
+			if err != nil {
+				log.Fatalf("apiSend Error: %v", err)
+			}
 		}
 	case *indir && *commandPtr == "load":
-		method = "POST"
 		url, err = doGetLoadURL(*tablePtr)
 		if err != nil {
 			log.Fatalf("Not valid URL for table\n")
 		}
 
-		files, err := ioutil.ReadDir(*filename)
+		// A draft load sends to other IDs than a live one, so it does not
+		// resume from the live load's state, or the other way round.
+		st, err := run.ReadLoadState(*statefile, *filename, draftID(*tablePtr, *draft))
+		if err != nil {
+			log.Fatalf("Cannot read state file: %v\n", err)
+		}
+
+		items := loadPages(*filename, *tablePtr, *intype, opts)
+		if *draft {
+			err = draftItems(items)
+			if err != nil {
+				log.Fatalf("Not valid payload: %v\n", err)
+			}
+		}
+
+		var known, knownMeta map[string]string
+		var m manifest
+		switch *changed {
+		case "off":
+		case "manifest":
+			m, err = readManifest(*manifestFile)
+			if err != nil {
+				log.Fatalf("Cannot read manifest: %v\n", err)
+			}
+			known = m.Tables[*tablePtr]
+			knownMeta = m.Tables["pagemetadata"]
+		case "server":
+			known, err = serverHashes(abort, url)
+			if err != nil {
+				log.Fatalf("Cannot fetch current items: %v\n", err)
+			}
+			if opts.Metadata == "table" {
+				var metaURL string
+				metaURL, err = doGetLoadURL("pagemetadata")
+				if err == nil {
+					knownMeta, err = serverHashes(abort, metaURL)
+				}
+				if err != nil && !isStatus(err, http.StatusNotFound) {
+					log.Fatalf("Cannot fetch current metadata: %v\n", err)
+				}
+			}
+		default:
+			log.Fatalf("Not a valid changed mode: %v\n", *changed)
+		}
+
+		var cs changeSet
+		if *changed != "off" {
+			cs, err = compareItems(items, known, knownMeta)
+			if err != nil {
+				log.Fatalf("Not valid payload: %v\n", err)
+			}
+			cs.print(os.Stdout)
+			items = cs.Send
+		}
+		sent := map[string]string{}
+		sentMeta := map[string]string{}
+
+		names := make([]string, len(items))
+		for i, item := range items {
+			names[i] = item.Name
+		}
+		prog := run.NewProgress("load", len(items), st.Sent(names), *quiet)
+		echoRequests = !prog.Drawing()
+
+		var sendErr error
+		for _, item := range items {
+			if st.Done[item.Name] {
+				continue
+			}
+			if stop.Err() != nil {
+				break
+			}
+
+			err = sendItem(abort, url, item, st.Assets)
+			if err != nil {
+				prog.Fail()
+				sendErr = err
+				break
+			}
+
+			// sendItem only returns nil once the server has accepted the
+			// item, so a rejected item keeps its old hash and is sent again
+			// by the next load.
+			st.Done[item.Name] = true
+			if id, ok := cs.IDs[item.Name]; ok {
+				sent[id] = cs.Hashes[id]
+				if hash, ok := cs.MetaHashes[id]; ok {
+					sentMeta[id] = hash
+				}
+			}
+			err = run.WriteLoadState(*statefile, st)
+			if err != nil {
+				log.Fatalf("Cannot write state file: %v\n", err)
+			}
+			prog.Add(1)
+		}
+		prog.Finish()
+
+		if *changed == "manifest" && len(sent) > 0 {
+			for table, hashes := range map[string]map[string]string{*tablePtr: sent, "pagemetadata": sentMeta} {
+				if len(hashes) == 0 {
+					continue
+				}
+				if m.Tables[table] == nil {
+					m.Tables[table] = map[string]string{}
+				}
+				for id, hash := range hashes {
+					m.Tables[table][id] = hash
+				}
+			}
+			err = writeManifest(*manifestFile, m)
+			if err != nil {
+				log.Printf("Cannot write manifest: %v\n", err)
+			}
+		}
+
+		if sendErr != nil {
+			log.Printf("apiSend Error: %v", sendErr)
+		}
+		if sendErr != nil || stop.Err() != nil {
+			log.Printf("Stopped after %v of %v files; rerun to resume from %v\n", st.Sent(names), len(items), *statefile)
+			release()
+			os.Exit(1)
+		}
+		run.RemoveLoadState(*statefile)
+	case *indir && *commandPtr == "index":
+		if action := flag.Arg(0); action != "" && action != "build" {
+			log.Fatalf("Not a valid index action: %v\n", action)
+		}
+
+		items := loadPages(*filename, "fullpage", *intype, opts)
+		idx, err := buildSearchIndex(items)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("Cannot build index: %v\n", err)
 		}
+		err = writeSearchIndex(*outfile, idx)
+		if err != nil {
+			log.Fatalf("Cannot write index: %v\n", err)
+		}
+		fmt.Printf("index: %v pages, %v terms written to %v\n", len(idx.Pages), len(idx.Terms), *outfile)
 
-		for _, file := range files {
-			fullfilename := *filename + "/" + file.Name()
-			switch *intype {
-			case "html":
-				js, err = doLoadHTML(*tablePtr, fullfilename)
-			case "json":
-				js, err = doLoadJSON(*tablePtr, fullfilename)
-			default:
-				log.Fatalf("Not a valid intype\n")
+		if *upload {
+			err = sendSearchIndex(abort, idx, draftID(searchIndexID, *draft))
+			if err != nil {
+				log.Fatalf("apiSend Error: %v", err)
 			}
+		}
+	case *indir && *commandPtr == "book":
+		if action := flag.Arg(0); action != "" && action != "build" {
+			log.Fatalf("Not a valid book action: %v\n", action)
+		}
+
+		items := loadPages(*filename, "fullpage", *intype, opts)
+		var bookList []bookRecord
+		if *toc != "" {
+			bookList, err = readTOC(*toc)
 			if err != nil {
-				log.Fatalf("Not valid payload from file\n")
+				log.Fatalf("Cannot read TOC: %v\n", err)
+			}
+		} else {
+			bookList = booksFromLayout(items)
+		}
+
+		ids := map[string]bool{}
+		for _, item := range items {
+			ids[item.ID] = true
+		}
+		problems := checkBooks(bookList, ids)
+		for _, p := range problems {
+			log.Println(p)
+		}
+		if len(problems) > 0 {
+			log.Fatalf("%v problems, no books built\n", len(problems))
+		}
+
+		for i := range bookList {
+			if bookList[i].HandbookType == "" {
+				bookList[i].HandbookType = opts.HandbookType
 			}
-			err = apiSend(url, method, js)
+			if opts.Headings == "anchor" || opts.Headings == "toc" {
+				bookList[i].TOC, err = bookTOC(bookList[i], items)
+				if err != nil {
+					log.Fatalf("Cannot build book contents: %v\n", err)
+				}
+			}
+		}
+		err = writeBooks(*outdir, bookList)
+		if err != nil {
+			log.Fatalf("Cannot write books: %v\n", err)
+		}
+		fmt.Printf("book: %v books written to %v\n", len(bookList), *outdir)
+
+		if *upload {
+			err = sendBooks(abort, bookList, *draft)
 			if err != nil {
 				log.Fatalf("apiSend Error: %v", err)
 			}
 		}
+	case *indir && *commandPtr == "preview":
+		site := &previewSite{dir: *filename, intype: *intype, books: *books, opts: opts}
+		err = servePreview(stop, *addr, site)
+		if err != nil {
+			log.Fatalf("Cannot serve preview: %v\n", err)
+		}
+	case *commandPtr == "check":
+		c := newCheckSet()
+		if *filename != "" {
+			var items []loadItem
+			if *indir {
+				items, err = loadDir(*filename, "fullpage", *intype, opts)
+			} else {
+				var item loadItem
+				item, err = loadFile("fullpage", *intype, *filename, opts)
+				items = []loadItem{item}
+			}
+			if err != nil {
+				log.Fatalf("Cannot load pages: %v\n", err)
+			}
+			c.addLocal(items)
+		}
+		if *books != "" {
+			err = c.readBookFiles(*books)
+			if err != nil {
+				log.Fatalf("Cannot read books: %v\n", err)
+			}
+		}
+		if *messages != "" {
+			err = c.readMessageFiles(*messages)
+			if err != nil {
+				log.Fatalf("Cannot read update messages: %v\n", err)
+			}
+		}
+		if *server {
+			err = c.readServer(abort)
+			if err != nil {
+				log.Fatalf("Cannot read server tables: %v\n", err)
+			}
+		}
+		problems := c.check()
+		printCheck(os.Stdout, c, problems)
+		if len(problems) > 0 {
+			release()
+			os.Exit(1)
+		}
+	case *commandPtr == "export":
+		format := flag.Arg(0)
+		if format != "epub" && format != "site" {
+			log.Fatalf("Not a valid export format: %v\n", format)
+		}
+
+		var content *exportContent
+		switch {
+		case *server:
+			content, err = serverContent(abort)
+			if err != nil {
+				log.Fatalf("Cannot fetch content: %v\n", err)
+			}
+		case *indir:
+			// Pages need their assets as files, not left as local
+			// references.
+			if opts.Assets != "inline" {
+				opts.Assets = "upload"
+			}
+			items := loadPages(*filename, "fullpage", *intype, opts)
+			content, err = contentFromItems(items)
+			if err != nil {
+				log.Fatalf("Not valid payload: %v\n", err)
+			}
+			content.books = booksFromLayout(items)
+		default:
+			log.Fatalln("Export needs a directory (-indir) or -server")
+		}
+		switch {
+		case *toc != "":
+			content.books, err = readTOC(*toc)
+		case *books != "":
+			content.books, err = readBooks(*books)
+		}
+		if err != nil {
+			log.Fatalf("Cannot read books: %v\n", err)
+		}
+
+		exported := content.books
+		if format == "epub" {
+			exported, err = exportBooks(content.books, *bookID)
+			if err != nil {
+				log.Fatalf("Cannot export: %v\n", err)
+			}
+		}
+		ids := map[string]bool{}
+		for id := range content.pages {
+			ids[id] = true
+		}
+		problems := checkBooks(exported, ids)
+		for _, p := range problems {
+			log.Println(p)
+		}
+		if len(problems) > 0 {
+			log.Fatalf("%v problems, nothing exported\n", len(problems))
+		}
+
+		if format == "site" {
+			warnings, err := writeSite(*outdir, content, opts, *lang)
+			printWarnings(*outdir, warnings)
+			if err != nil {
+				log.Fatalf("Cannot export site: %v\n", err)
+			}
+			fmt.Printf("export: site of %v pages and %v books written to %v\n", len(content.pages), len(content.books), *outdir)
+			break
+		}
+
+		err = os.MkdirAll(*outdir, 0755)
+		if err != nil {
+			log.Fatalf("Cannot export: %v\n", err)
+		}
+		for _, b := range exported {
+			if b.HandbookType == "" {
+				b.HandbookType = opts.HandbookType
+			}
+			out := filepath.Join(*outdir, b.ID+".epub")
+			warnings, err := writeEPUB(out, content, b, opts, *lang, time.Now())
+			printWarnings(out, warnings)
+			if err != nil {
+				log.Fatalf("Cannot export %v: %v\n", b.ID, err)
+			}
+			fmt.Printf("export: %v, %v pages\n", out, len(bookPages(b)))
+		}
+	case *commandPtr == "pull":
+		res, err := pull(abort, *outdir, *tablePtr, *filter, *since)
+		printWarnings(*outdir, res.Warnings)
+		if err != nil {
+			log.Fatalf("Cannot pull: %v\n", err)
+		}
+		fmt.Printf("pull: %v written, %v removed, %v skipped in %v\n", res.Written, res.Removed, res.Skipped, *outdir)
+	case *commandPtr == "publish":
+		if action := flag.Arg(0); action != "" && action != "diff" {
+			log.Fatalf("Not a valid publish action: %v\n", action)
+		}
+		changes, err := draftChanges(abort)
+		if err != nil {
+			log.Fatalf("Cannot fetch drafts: %v\n", err)
+		}
+		printDrafts(os.Stdout, changes)
+		if flag.Arg(0) == "diff" || len(changes) == 0 {
+			break
+		}
+		err = publishDrafts(abort, changes, *releases)
+		if err != nil {
+			log.Fatalf("Cannot publish: %v\n", err)
+		}
+	case *commandPtr == "rollback":
+		err = rollbackRelease(abort, *releases, os.Stdout)
+		if err != nil {
+			log.Fatalf("Cannot roll back: %v\n", err)
+		}
+	case *commandPtr == "lint":
+		problems, err := lintFiles(*filename, *indir, os.Stdout)
+		if err != nil {
+			log.Fatalf("Cannot lint: %v\n", err)
+		}
+		if problems > 0 {
+			release()
+			os.Exit(1)
+		}
 	default:
 		log.Fatalln("Not a valid command")
 	}
 }
 
+// loadPages converts every file of a directory, printing warnings and
+// errors. It exits when any file has errors or two files share an ID, so
+// that nothing is sent from a partly valid directory.
+func loadPages(dir string, table string, intype string, opts fullpageOptions) []loadItem {
+	items, err := loadDir(dir, table, intype, opts)
+	errs := 0
+	for _, item := range items {
+		printWarnings(item.Name, item.Warnings)
+		errs += printErrors(item.Name, item.Errors)
+	}
+	if err != nil {
+		log.Fatalf("Not valid payload: %v\n", err)
+	}
+	if errs > 0 {
+		log.Fatalf("%v errors, nothing sent\n", errs)
+	}
+
+	dups := duplicateIDs(items)
+	for _, d := range dups {
+		log.Printf("Duplicate ID: %v\n", d)
+	}
+	if len(dups) > 0 {
+		log.Fatalf("%v duplicate IDs, nothing sent\n", len(dups))
+	}
+	return items
+}
+
+// serverCommands work on the server tables and need no -infile.
+var serverCommands = stringSet([]string{"check", "publish", "rollback", "export", "pull"})
+
+// apiBase is the address of the Mobile Apps server the tables are on.
+var apiBase = "http://localhost:55506/"
+
 func doGetLoadURL(table string) (url string, err error) {
-	base := "http://localhost:55506/"
+	base := apiBase
 	switch table {
 	case "fullpage":
 		url = base + "tables/fullpageitem/"
@@ -116,22 +606,30 @@ func doGetLoadURL(table string) (url string, err error) {
 		url = base + "tables/userupdatestatusitem/"
 	case "initialupdatejson":
 		url = base + "tables/initialupdatejsonitem/"
+	case "asset":
+		url = base + "tables/assetitem/"
+	case "pagemetadata":
+		url = base + "tables/pagemetadataitem/"
+	case "searchindex":
+		url = base + "tables/searchindexitem/"
 	default:
 		err = errors.New("Not defined table")
 	}
 	return
 }
 
-func apiSend(url string, method string, js string) (err error) {
-	fmt.Println(url)
-	fmt.Println(method)
-	fmt.Println(js)
+// apiGet fetches url and returns the response body.
+func apiGet(ctx context.Context, url string) (payload []byte, err error) {
+	if echoRequests {
+		fmt.Println(url)
+		fmt.Println("GET")
+	}
 
-	payload := []byte(js)
-	request, err := http.NewRequest(method, url, bytes.NewBuffer(payload))
+	request, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return
 	}
+	request = request.WithContext(ctx)
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("ZUMO-API-VERSION", "2.0.0")
 	request.Header.Set("X-ZUMO-AUTH", "--token-here--")
@@ -141,17 +639,92 @@ func apiSend(url string, method string, js string) (err error) {
 	client := &http.Client{Transport: tr}
 	response, err := client.Do(request)
 	if err != nil {
-		return err
+		return
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		err = &apiError{Method: "GET", URL: url, Status: response.Status, StatusCode: response.StatusCode, Body: string(bytes.TrimSpace(body))}
+		return
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// echoRequests controls whether apiSend prints each request. It is turned off
+// while a progress line is being drawn on the terminal.
+var echoRequests = true
+
+func apiSend(ctx context.Context, url string, method string, js string) (err error) {
+	if echoRequests {
+		fmt.Println(url)
+		fmt.Println(method)
+		fmt.Println(js)
+	}
+
+	payload := []byte(js)
+	request, err := http.NewRequest(method, url, bytes.NewBuffer(payload))
+	if err != nil {
+		return
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("ZUMO-API-VERSION", "2.0.0")
+	request.Header.Set("X-ZUMO-AUTH", "--token-here--")
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	client := &http.Client{Transport: tr}
+	response, err := client.Do(request)
 	if err != nil {
 		return err
 	}
+	defer response.Body.Close()
 
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return &apiError{Method: method, URL: url, Status: response.Status, StatusCode: response.StatusCode, Body: string(bytes.TrimSpace(body))}
+	}
 	return nil
 }
 
+// apiError is returned for a request the server answered with a status
+// other than 2xx.
+type apiError struct {
+	Method     string
+	URL        string
+	Status     string
+	StatusCode int
+	Body       string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%v %v: %v: %v", e.Method, e.URL, e.Status, e.Body)
+}
+
+// isStatus reports whether err is an apiError with the given status code.
+func isStatus(err error, code int) bool {
+	e, ok := err.(*apiError)
+	return ok && e.StatusCode == code
+}
+
+// apiUpsert writes the item js to the table at tableURL. It is created with
+// a POST; when the server already has its ID, which it answers with 409
+// Conflict, the item is updated with a PATCH instead.
+func apiUpsert(ctx context.Context, tableURL string, js string) (err error) {
+	err = apiSend(ctx, tableURL, "POST", js)
+	if !isStatus(err, http.StatusConflict) {
+		return
+	}
+	var item struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal([]byte(js), &item) != nil || item.ID == "" {
+		return
+	}
+	return apiSend(ctx, tableURL+url.PathEscape(item.ID), "PATCH", js)
+}
+
 func isInFile(i string) bool {
 	info, err := os.Stat(i)
 	if err != nil {
@@ -178,34 +751,78 @@ func isInFileDirectory(i string) bool {
 	return false
 }
 
-func doLoadHTML(table string, filename string) (js string, err error) {
+// loadFile converts one input file of the given type into a loadItem.
+func loadFile(table string, intype string, filename string, opts fullpageOptions) (item loadItem, err error) {
+	item.Name = filepath.Base(filename)
+	switch intype {
+	case "html":
+		item, err = doLoadHTML(table, filename, opts)
+	case "markdown":
+		item, err = doLoadMarkdown(table, filename, opts)
+	case "docx":
+		item, err = doLoadDocx(table, filename, opts)
+	case "json":
+		item.JS, err = doLoadJSON(table, filename)
+		if err == nil && table == "fullpage" {
+			var fp *hb.Fullpage
+			fp, err = item.page()
+			if fp != nil {
+				item.ID = fp.ID
+			}
+		}
+	default:
+		err = fmt.Errorf("Not a valid intype: %v", intype)
+	}
+	return
+}
+
+func doLoadHTML(table string, filename string, opts fullpageOptions) (item loadItem, err error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return
 	}
+	defer f.Close()
+
+	item.Name = filepath.Base(filename)
 
 	switch table {
 	case "fullpage":
 		var htmlbyte []byte
-		name := filepath.Base(filename)
-		id := name[:len(name)-5]
+		var id string
+		id, err = fullpageID(item.Name, opts)
+		if err != nil {
+			return
+		}
 		htmlbyte, err = ioutil.ReadAll(f)
 		if err != nil {
 			return
 		}
 
-		var fp hb.Fullpage
-		fp, err = htmlToFullpage(id, string(htmlbyte))
+		var text string
+		var warnings []string
+		text, warnings, err = decodeHTML(htmlbyte, opts.Normalize)
 		if err != nil {
 			return
 		}
 
-		var payload []byte
-		payload, err = json.Marshal(fp)
+		front, content := splitFrontMatter(text)
+		var fields map[string]string
+		fields, err = parseFrontMatter(front)
 		if err != nil {
+			err = fmt.Errorf("front matter: %v", err)
 			return
 		}
-		js = string(payload)
+
+		if opts.Layouts != nil && isFragment(content) {
+			content, err = wrapFragment(id, content, fields, opts)
+			if err != nil {
+				err = fmt.Errorf("layout: %v", err)
+				return
+			}
+		}
+
+		item, err = fullpageItem(filename, id, content, fields, opts)
+		item.Warnings = append(warnings, item.Warnings...)
 	default:
 		err = errors.New("No table defined")
 		return
@@ -300,24 +917,12 @@ func doLoadJSON(table string, filename string) (js string, err error) {
 	return
 }
 
-func htmlToFullpage(id string, htmlstring string) (fp hb.Fullpage, err error) {
-	fp.ID = id
-	fp.Content = string(htmlstring)
-	z, err := html.Parse(strings.NewReader(fp.Content))
-	if err != nil {
-		return
-	}
-
-	var ff func(*html.Node)
-	ff = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "title" {
-			fp.Title = n.FirstChild.Data
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			ff(c)
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) (list []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
 		}
 	}
-
-	ff(z)
 	return
 }
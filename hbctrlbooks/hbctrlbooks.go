@@ -2,11 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -14,18 +16,22 @@ import (
 
 	"github.com/SermoDigital/jose/jws"
 	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/run"
 )
 
 func main() {
 	dirname := flag.String("indir", "", "Input Directory name")
 	base := flag.String("url", "http://localhost:55506/", "base Url")
 	keyfile := flag.String("keyfile", "", "Key File")
+	quiet := flag.Bool("quiet", false, "Do not show progress")
+	statefile := flag.String("state", "hbctrlbooks.state", "State file for resuming a load")
 
 	flag.Parse()
 
 	fmt.Println("infile:  ", *dirname)
 	fmt.Println("url: ", *base)
 	fmt.Println("keyfile: ", *keyfile)
+	fmt.Println("state: ", *statefile)
 
 	if !isInFileDirectory(*dirname) {
 		log.Fatalln("Not a valid directory")
@@ -41,18 +47,58 @@ func main() {
 		log.Fatal(err)
 	}
 
+	st, err := run.ReadLoadState(*statefile, *dirname, url)
+	if err != nil {
+		log.Fatalf("Cannot read state file: %v\n", err)
+	}
+
+	stop, abort, release := run.InterruptContexts()
+	defer release()
+
+	prog := run.NewProgress("load", len(files), len(st.Done), *quiet)
+	echoRequests = !prog.Drawing()
+
+	var sendErr error
 	for _, file := range files {
+		if st.Done[file.Name()] {
+			continue
+		}
+		if stop.Err() != nil {
+			break
+		}
+
 		fullfilename := *dirname + "/" + file.Name()
 		js, err := doLoadJSON(fullfilename)
 		if err != nil {
 			log.Fatalf("Not valid payload from file: %v\n", file.Name())
 		}
 
-		err = apiSend(url, method, js, token)
+		err = apiSend(abort, url, method, js, token)
+		if err != nil {
+			prog.Fail()
+			sendErr = err
+			break
+		}
+
+		st.Done[file.Name()] = true
+		err = run.WriteLoadState(*statefile, st)
 		if err != nil {
-			log.Fatalf("apiSend Error: %v", err)
+			log.Fatalf("Cannot write state file: %v\n", err)
 		}
+		prog.Add(1)
+	}
+	prog.Finish()
+
+	if sendErr != nil {
+		log.Printf("apiSend Error: %v", sendErr)
 	}
+	if sendErr != nil || stop.Err() != nil {
+		log.Printf("Stopped after %v of %v files; rerun to resume from %v\n", len(st.Done), len(files), *statefile)
+		release()
+		os.Exit(1)
+	}
+
+	run.RemoveLoadState(*statefile)
 }
 
 func getToken(keyfile string) string {
@@ -81,12 +127,17 @@ func getToken(keyfile string) string {
 	return string(byteToken)
 }
 
-func apiSend(url string, method string, js string, token string) (err error) {
+// echoRequests controls whether apiSend prints each response. It is turned
+// off while a progress line is being drawn on the terminal.
+var echoRequests = true
+
+func apiSend(ctx context.Context, url string, method string, js string, token string) (err error) {
 	payload := []byte(js)
 	request, err := http.NewRequest(method, url, bytes.NewBuffer(payload))
 	if err != nil {
 		return
 	}
+	request = request.WithContext(ctx)
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("ZUMO-API-VERSION", "2.0.0")
 	request.Header.Set("X-ZUMO-AUTH", token)
@@ -98,13 +149,15 @@ func apiSend(url string, method string, js string, token string) (err error) {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Response: %v\n", response.Status)
+	if echoRequests {
+		fmt.Printf("Response: %v\n", response.Status)
+	}
 	defer response.Body.Close()
 
-	if err != nil {
-		return err
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%v %v: %v: %s", method, url, response.Status, bytes.TrimSpace(body))
 	}
-
 	return nil
 }
 
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -15,6 +17,7 @@ import (
 
 	"github.com/SermoDigital/jose/jws"
 	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/run"
 )
 
 type RestResult struct {
@@ -22,73 +25,200 @@ type RestResult struct {
 	Count   int
 }
 
+// exportState records how far a paged AppLog export got, so an interrupted
+// run can carry on with the same output file instead of starting over.
+// Offset is the size of the output once the pages before Skip were written;
+// a resumed run cuts the file back to it, dropping rows of a page whose
+// state was never recorded.
+type exportState struct {
+	Url     string `json:"url"`
+	Outfile string `json:"outfile"`
+	Skip    int    `json:"skip"`
+	Offset  int64  `json:"offset"`
+}
+
 func main() {
 	base := flag.String("url", "http://localhost:55506/", "base Url")
 	keyfile := flag.String("keyfile", "", "Key File")
 	outputfile := flag.String("outfile", "output.csv", "Outputfilename")
+	quiet := flag.Bool("quiet", false, "Do not show progress")
+	statefile := flag.String("state", "", "State file for resuming (default outfile + \".state\")")
 
 	flag.Parse()
 
+	if *statefile == "" {
+		*statefile = *outputfile + ".state"
+	}
+
 	fmt.Println("url: ", *base)
 	fmt.Println("keyfile: ", *keyfile)
 	fmt.Println("outfile: ", *outputfile)
+	fmt.Println("state: ", *statefile)
+
+	token := getToken(*keyfile)
+
+	url := *base + "tables/AppLogItem/"
 
-	file, err := os.Create(*outputfile)
+	st, err := readExportState(*statefile, url, *outputfile)
+	if err != nil {
+		log.Fatalf("Cannot read state file: %v\n", err)
+	}
+
+	file, err := os.OpenFile(*outputfile, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		log.Fatalf("Cannot create output file: %v\n", err)
 	}
-	defer file.Close()
+	err = file.Truncate(st.Offset)
+	if err == nil {
+		_, err = file.Seek(st.Offset, io.SeekStart)
+	}
+	if err != nil {
+		log.Fatalf("Cannot resume output file: %v\n", err)
+	}
 
-	writer := csv.NewWriter(file)
+	stop, abort, release := run.InterruptContexts()
 
-	token := getToken(*keyfile)
+	prog := run.NewProgress("applog", 0, st.Skip, *quiet)
+	echoRequests = !prog.Drawing()
 
-	url := *base + "tables/AppLogItem/"
-	method := "GET"
+	writer := csv.NewWriter(file)
+	exportErr := exportAppLogs(stop, abort, file, writer, url, token, &st, *statefile, prog)
+	if exportErr != nil {
+		prog.Fail()
+	}
+	prog.Finish()
 
-	top := 50
-	skip := 0
+	writer.Flush()
+	if err := writer.Error(); err != nil && exportErr == nil {
+		exportErr = err
+	}
+	if err := file.Close(); err != nil && exportErr == nil {
+		exportErr = err
+	}
+	stopped := stop.Err() != nil
+	release()
 
-	resultsCount := 0
+	if exportErr != nil || stopped {
+		if exportErr != nil {
+			log.Printf("Error is: %v", exportErr)
+		}
+		log.Printf("Stopped at skip=%v; rerun to resume from %v\n", st.Skip, *statefile)
+		os.Exit(1)
+	}
 
-	var totalresults []hb.AppLog
+	err = os.Remove(*statefile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Cannot remove state file: %v\n", err)
+	}
+}
 
-	defer writer.Flush()
+// exportAppLogs pages through the AppLog table, writing each page to writer,
+// which writes to file. The state file is only advanced once a page has been
+// synced to disk, and records the offset it ends at.
+func exportAppLogs(stop context.Context, abort context.Context, file *os.File, writer *csv.Writer, url string, token string, st *exportState, statefile string, prog *run.Progress) (err error) {
+	method := "GET"
+
+	top := 50
 
 	for {
-		httpstring := fmt.Sprintf("%s?$top=%v&$skip=%v&$inlinecount=allpages", url, top, skip)
-		fmt.Println(httpstring)
-		payload, err := apiSend(httpstring, method, token)
+		if stop.Err() != nil {
+			return nil
+		}
+
+		httpstring := fmt.Sprintf("%s?$top=%v&$skip=%v&$inlinecount=allpages", url, top, st.Skip)
+		if echoRequests {
+			fmt.Println(httpstring)
+		}
+		payload, err := apiSend(abort, httpstring, method, token)
 		if err != nil {
-			log.Fatalf("Error is: %v", err)
+			return err
 		}
 
 		var results RestResult
 		err = json.Unmarshal(payload, &results)
 		if err != nil {
-			log.Fatalf("Error is: %v", err)
+			return err
 		}
 
-		resultsCount = resultsCount + top
-		totalresults = append(totalresults, results.Results...)
-
 		for _, applog := range results.Results {
 			data := []string{applog.UserID, applog.LogDateTime, applog.LogName, applog.LogDataJson}
 			err := writer.Write(data)
 			if err != nil {
-				log.Fatal("Cannot write to file: ", err)
+				return fmt.Errorf("Cannot write to file: %v", err)
 			}
 		}
+		writer.Flush()
+		err = writer.Error()
+		if err == nil {
+			err = file.Sync()
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot write to file: %v", err)
+		}
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("Cannot write to file: %v", err)
+		}
 
-		fmt.Printf("resultsCount: %v; totalresults %v; results %v\n", resultsCount, results.Count, len(totalresults))
+		st.Skip = st.Skip + top
+		st.Offset = offset
+		err = writeExportState(statefile, *st)
+		if err != nil {
+			return fmt.Errorf("Cannot write state file: %v", err)
+		}
 
-		if resultsCount > results.Count {
-			break
+		if echoRequests {
+			fmt.Printf("resultsCount: %v; totalresults %v; results %v\n", st.Skip, results.Count, len(results.Results))
 		}
+		prog.SetTotal(results.Count)
+		prog.Add(len(results.Results))
 
-		skip = skip + top
+		if st.Skip > results.Count {
+			return nil
+		}
 	}
+}
+
+func readExportState(filename string, url string, outfile string) (st exportState, err error) {
+	st = exportState{Url: url, Outfile: outfile}
 
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return
+	}
+
+	var prev exportState
+	err = json.Unmarshal(data, &prev)
+	if err != nil {
+		return
+	}
+	if prev.Url != url || prev.Outfile != outfile {
+		log.Printf("State file %v is for %v, starting over\n", filename, prev.Outfile)
+		return
+	}
+	// The output is cut back to the recorded offset on resume. If it has
+	// been removed or cut short since, extending it would pad it with zero
+	// bytes, so the export starts over instead.
+	info, err := os.Stat(outfile)
+	if err != nil || info.Size() < prev.Offset {
+		log.Printf("Output %v is missing or shorter than %v recorded, starting over\n", outfile, filename)
+		return st, nil
+	}
+	st.Skip = prev.Skip
+	st.Offset = prev.Offset
+	log.Printf("Resuming from %v at skip=%v\n", filename, st.Skip)
+	return
+}
+
+func writeExportState(filename string, st exportState) (err error) {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return
+	}
+	return run.WriteFile(filename, data)
 }
 
 func getToken(keyfile string) string {
@@ -117,12 +247,17 @@ func getToken(keyfile string) string {
 	return string(byteToken)
 }
 
-func apiSend(url string, method string, token string) (payload []byte, err error) {
+// echoRequests controls whether requests and responses are printed. It is
+// turned off while a progress line is being drawn on the terminal.
+var echoRequests = true
+
+func apiSend(ctx context.Context, url string, method string, token string) (payload []byte, err error) {
 	inpayload := []byte("")
 	request, err := http.NewRequest(method, url, bytes.NewBuffer(inpayload))
 	if err != nil {
 		return nil, err
 	}
+	request = request.WithContext(ctx)
 
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("ZUMO-API-VERSION", "2.0.0")
@@ -136,9 +271,15 @@ func apiSend(url string, method string, token string) (payload []byte, err error
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("Response: %v\n", response.Status)
+	if echoRequests {
+		fmt.Printf("Response: %v\n", response.Status)
+	}
 	defer response.Body.Close()
 
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return nil, fmt.Errorf("%v %v: %v: %s", method, url, response.Status, bytes.TrimSpace(body))
+	}
 	payload, err = ioutil.ReadAll(response.Body)
 	if err != nil {
 		return nil, err
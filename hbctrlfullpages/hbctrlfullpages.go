@@ -2,33 +2,42 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/SermoDigital/jose/jws"
 	hb "github.com/rstanleyhum/handbookappdb"
-	"golang.org/x/net/html"
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"github.com/rstanleyhum/hbctrl/internal/itemid"
+	"github.com/rstanleyhum/hbctrl/internal/run"
 )
 
 func main() {
 	dirname := flag.String("indir", "", "Input Directory name")
 	base := flag.String("url", "http://localhost:55506/", "base Url")
 	keyfile := flag.String("keyfile", "", "Key File")
+	defaultTitle := flag.String("default-title", "", "Title for pages without a <title> or <h1>")
+	idStrategy := flag.String("id", "ext", "Fullpage ID strategy: ext, slug, meta or map")
+	idMapFile := flag.String("idmap", "", "JSON file mapping file names to Fullpage IDs (for -id map)")
+	quiet := flag.Bool("quiet", false, "Do not show progress")
+	statefile := flag.String("state", "hbctrlfullpages.state", "State file for resuming a load")
 
 	flag.Parse()
 
 	fmt.Println("infile:  ", *dirname)
 	fmt.Println("url: ", *base)
 	fmt.Println("keyfile: ", *keyfile)
+	fmt.Println("state: ", *statefile)
 
 	if !isInFileDirectory(*dirname) {
 		log.Fatalln("Not a valid directory")
@@ -44,18 +53,84 @@ func main() {
 		log.Fatal(err)
 	}
 
+	st, err := run.ReadLoadState(*statefile, *dirname, url)
+	if err != nil {
+		log.Fatalf("Cannot read state file: %v\n", err)
+	}
+
+	stop, abort, release := run.InterruptContexts()
+	defer release()
+
+	opts := fullpageOptions{
+		DefaultTitle: *defaultTitle,
+		IDStrategy:   *idStrategy,
+	}
+	if *idMapFile != "" {
+		opts.IDMap, err = itemid.ReadMap(*idMapFile)
+		if err != nil {
+			log.Fatalf("Cannot read ID map: %v\n", err)
+		}
+	}
+
+	var items []loadItem
 	for _, file := range files {
 		fullfilename := *dirname + "/" + file.Name()
-		js, err := doLoadHTML(fullfilename)
+		item, err := doLoadHTML(fullfilename, opts)
 		if err != nil {
-			log.Fatalf("Not valid payload from file: %v\n", file.Name())
+			log.Fatalf("Not valid payload from file: %v: %v\n", file.Name(), err)
 		}
+		for _, w := range item.Warnings {
+			log.Printf("Warning: %v: %v\n", file.Name(), w)
+		}
+		items = append(items, item)
+	}
 
-		err = apiSend(url, method, js, token)
+	dups := duplicateIDs(items)
+	for _, d := range dups {
+		log.Printf("Duplicate ID: %v\n", d)
+	}
+	if len(dups) > 0 {
+		log.Fatalf("%v duplicate IDs, nothing sent\n", len(dups))
+	}
+
+	prog := run.NewProgress("load", len(items), len(st.Done), *quiet)
+	echoRequests = !prog.Drawing()
+
+	var sendErr error
+	for _, item := range items {
+		if st.Done[item.Name] {
+			continue
+		}
+		if stop.Err() != nil {
+			break
+		}
+
+		err = apiSend(abort, url, method, item.JS, token)
 		if err != nil {
-			log.Fatalf("apiSend Error: %v", err)
+			prog.Fail()
+			sendErr = err
+			break
 		}
+
+		st.Done[item.Name] = true
+		err = run.WriteLoadState(*statefile, st)
+		if err != nil {
+			log.Fatalf("Cannot write state file: %v\n", err)
+		}
+		prog.Add(1)
+	}
+	prog.Finish()
+
+	if sendErr != nil {
+		log.Printf("apiSend Error: %v", sendErr)
 	}
+	if sendErr != nil || stop.Err() != nil {
+		log.Printf("Stopped after %v of %v files; rerun to resume from %v\n", len(st.Done), len(items), *statefile)
+		release()
+		os.Exit(1)
+	}
+
+	run.RemoveLoadState(*statefile)
 }
 
 func getToken(keyfile string) string {
@@ -85,12 +160,17 @@ func getToken(keyfile string) string {
 	return string(byteToken)
 }
 
-func apiSend(url string, method string, js string, token string) (err error) {
+// echoRequests controls whether apiSend prints each response. It is turned
+// off while a progress line is being drawn on the terminal.
+var echoRequests = true
+
+func apiSend(ctx context.Context, url string, method string, js string, token string) (err error) {
 	payload := []byte(js)
 	request, err := http.NewRequest(method, url, bytes.NewBuffer(payload))
 	if err != nil {
 		return
 	}
+	request = request.WithContext(ctx)
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("ZUMO-API-VERSION", "2.0.0")
 	request.Header.Set("X-ZUMO-AUTH", token)
@@ -102,13 +182,15 @@ func apiSend(url string, method string, js string, token string) (err error) {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Response: %v\n", response.Status)
+	if echoRequests {
+		fmt.Printf("Response: %v\n", response.Status)
+	}
 	defer response.Body.Close()
 
-	if err != nil {
-		return err
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%v %v: %v: %s", method, url, response.Status, bytes.TrimSpace(body))
 	}
-
 	return nil
 }
 
@@ -124,54 +206,84 @@ func isInFileDirectory(i string) bool {
 	return false
 }
 
-func doLoadHTML(filename string) (js string, err error) {
+// fullpageOptions configures how an HTML file is turned into a hb.Fullpage.
+type fullpageOptions struct {
+	// DefaultTitle is used when a page has neither a <title> nor an <h1>.
+	DefaultTitle string
+	// IDStrategy is how the Fullpage ID is derived: "ext" strips the file
+	// extension, "slug" also slugifies the name, "meta" reads
+	// <meta name="hb-id"> and "map" looks the file up in IDMap.
+	IDStrategy string
+	IDMap      map[string]string
+}
+
+// loadItem is one input file converted into the payload that is sent.
+type loadItem struct {
+	// Name is the file name within the load directory.
+	Name string
+	// ID is the item's ID when it is known before sending.
+	ID       string
+	JS       string
+	Warnings []string
+}
+
+func doLoadHTML(filename string, opts fullpageOptions) (item loadItem, err error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return
 	}
+	defer f.Close()
 
 	var htmlbyte []byte
-	name := filepath.Base(filename)
-	id := name[:len(name)-5]
+	item.Name = filepath.Base(filename)
+	id, err := fullpageID(item.Name, opts)
+	if err != nil {
+		return
+	}
 	htmlbyte, err = ioutil.ReadAll(f)
 	if err != nil {
 		return
 	}
 
 	var fp hb.Fullpage
-	fp, err = htmlToFullpage(id, string(htmlbyte))
+	fp, item.Warnings, err = htmlpage.Fullpage(id, string(htmlbyte), opts.pageOptions())
 	if err != nil {
 		return
 	}
+	item.ID = fp.ID
 
 	var payload []byte
 	payload, err = json.Marshal(fp)
 	if err != nil {
 		return
 	}
-	js = string(payload)
+	item.JS = string(payload)
 
 	return
 }
 
-func htmlToFullpage(id string, htmlstring string) (fp hb.Fullpage, err error) {
-	fp.ID = id
-	fp.Content = string(htmlstring)
-	z, err := html.Parse(strings.NewReader(fp.Content))
-	if err != nil {
-		return
-	}
+// pageOptions returns the options htmlpage reads a page with.
+func (opts fullpageOptions) pageOptions() htmlpage.Options {
+	return htmlpage.Options{DefaultTitle: opts.DefaultTitle, MetaID: opts.IDStrategy == "meta"}
+}
 
-	var ff func(*html.Node)
-	ff = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "title" {
-			fp.Title = n.FirstChild.Data
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			ff(c)
-		}
+// fullpageID derives a Fullpage ID from a file name according to
+// opts.IDStrategy. The "meta" strategy starts from the "ext" ID and is
+// overridden by htmlpage.Fullpage when the page has an hb-id meta tag.
+func fullpageID(name string, opts fullpageOptions) (id string, err error) {
+	strategy := opts.IDStrategy
+	if strategy == "meta" {
+		strategy = "ext"
 	}
+	return itemid.FromName(name, strategy, opts.IDMap)
+}
 
-	ff(z)
-	return
+// duplicateIDs describes every ID that more than one item of a load maps to.
+func duplicateIDs(items []loadItem) (dups []string) {
+	ids := make([]string, len(items))
+	names := make([]string, len(items))
+	for i, item := range items {
+		ids[i], names[i] = item.ID, item.Name
+	}
+	return itemid.Duplicates(ids, names)
 }
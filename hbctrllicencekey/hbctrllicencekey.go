@@ -2,20 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/SermoDigital/jose/jws"
 	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/run"
 )
 
 func main() {
@@ -38,7 +42,15 @@ func main() {
 	fmt.Printf("url: %v\n", url)
 	fmt.Printf("method: %v\n", method)
 
+	stop, abort, release := run.InterruptContexts()
+	defer release()
+
+	created := 0
+	var err error
 	for i := 0; i < 200; i++ {
+		if stop.Err() != nil {
+			break
+		}
 
 		var lk hb.LicenceKey
 
@@ -46,16 +58,24 @@ func main() {
 		lk.ID = strings.ToLower(RandStringRunes(6))
 
 		var payload []byte
-		payload, err := json.Marshal(lk)
+		payload, err = json.Marshal(lk)
 		if err != nil {
 			log.Fatal("Problem with payload")
 		}
 		js := string(payload)
 
-		err = apiSend(url, method, js, token)
+		err = apiSend(abort, url, method, js, token)
 		if err != nil {
-			log.Fatalf("apiSend Error: %v", err)
+			log.Printf("apiSend Error: %v", err)
+			break
 		}
+		created++
+	}
+
+	fmt.Printf("Created %v licence keys\n", created)
+	if err != nil || stop.Err() != nil {
+		release()
+		os.Exit(1)
 	}
 }
 
@@ -89,12 +109,13 @@ func getToken(keyfile string) string {
 	return string(byteToken)
 }
 
-func apiSend(url string, method string, js string, token string) (err error) {
+func apiSend(ctx context.Context, url string, method string, js string, token string) (err error) {
 	payload := []byte(js)
 	request, err := http.NewRequest(method, url, bytes.NewBuffer(payload))
 	if err != nil {
 		return
 	}
+	request = request.WithContext(ctx)
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("ZUMO-API-VERSION", "2.0.0")
 	request.Header.Set("X-ZUMO-AUTH", token)
@@ -109,10 +130,10 @@ func apiSend(url string, method string, js string, token string) (err error) {
 	fmt.Printf("Response: %v\n", response.Status)
 	defer response.Body.Close()
 
-	if err != nil {
-		return err
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%v %v: %v: %s", method, url, response.Status, bytes.TrimSpace(body))
 	}
-
 	return nil
 }
 
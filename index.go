@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"golang.org/x/net/html"
+)
+
+const (
+	searchIndexVersion = 1
+	searchIndexID      = "searchindex"
+	snippetLength      = 200
+)
+
+// searchIndex is an inverted index over the visible text of a set of
+// Fullpages, small enough to ship to the app for offline search.
+type searchIndex struct {
+	Version int `json:"version"`
+	// Stemmer names the algorithm applied to terms. Queries must be
+	// stemmed the same way.
+	Stemmer string      `json:"stemmer"`
+	Pages   []indexPage `json:"pages"`
+	// Terms maps each stemmed term to flattened (page, section, count)
+	// triples, where page indexes Pages and section indexes that page's
+	// Sections.
+	Terms map[string][]int `json:"terms"`
+}
+
+// indexPage is one Fullpage of the index.
+type indexPage struct {
+	ID      string `json:"id"`
+	Title   string `json:"title"`
+	Snippet string `json:"snippet,omitempty"`
+	// Sections are the parts of the page between headings. Section 0 is
+	// the top of the page.
+	Sections []indexSection `json:"sections"`
+}
+
+// indexSection is the part of a page under one heading.
+type indexSection struct {
+	// Anchor is the heading's id, when it has one, for linking to it.
+	Anchor  string `json:"anchor,omitempty"`
+	Heading string `json:"heading,omitempty"`
+}
+
+// searchIndexItem is the row the index is uploaded as.
+type searchIndexItem struct {
+	ID        string `json:"id"`
+	IndexJson string `json:"indexJson"`
+}
+
+// headingElements are the elements that start a new section.
+var headingElements = stringSet([]string{"h1", "h2", "h3", "h4", "h5", "h6"})
+
+// posting counts the occurrences of a term in one section of one page.
+type posting struct {
+	page, section int
+}
+
+// buildSearchIndex indexes the pages of a load. JSON items are decoded as
+// Fullpages; items without a page are skipped.
+func buildSearchIndex(items []loadItem) (idx *searchIndex, err error) {
+	var pages []hb.Fullpage
+	for _, item := range items {
+		var fp *hb.Fullpage
+		fp, err = item.page()
+		if err != nil {
+			return
+		}
+		if fp != nil {
+			pages = append(pages, *fp)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].ID < pages[j].ID })
+
+	idx = &searchIndex{Version: searchIndexVersion, Stemmer: "porter"}
+	counts := map[string]map[posting]int{}
+	for i, fp := range pages {
+		var page indexPage
+		page, err = indexFullpage(fp, func(section int, text string) {
+			for _, term := range searchTerms(text) {
+				if counts[term] == nil {
+					counts[term] = map[posting]int{}
+				}
+				counts[term][posting{i, section}]++
+			}
+		})
+		if err != nil {
+			err = fmt.Errorf("%v: %v", fp.ID, err)
+			return
+		}
+		idx.Pages = append(idx.Pages, page)
+	}
+
+	idx.Terms = map[string][]int{}
+	for term, ps := range counts {
+		keys := make([]posting, 0, len(ps))
+		for p := range ps {
+			keys = append(keys, p)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].page != keys[j].page {
+				return keys[i].page < keys[j].page
+			}
+			return keys[i].section < keys[j].section
+		})
+		flat := make([]int, 0, 3*len(keys))
+		for _, p := range keys {
+			flat = append(flat, p.page, p.section, ps[p])
+		}
+		idx.Terms[term] = flat
+	}
+	return
+}
+
+// indexFullpage splits fp into sections at its headings and passes the
+// visible text of each section to add. The title counts as text of the top
+// section.
+func indexFullpage(fp hb.Fullpage, add func(section int, text string)) (page indexPage, err error) {
+	doc, err := html.Parse(strings.NewReader(fp.Content))
+	if err != nil {
+		return
+	}
+
+	page = indexPage{ID: fp.ID, Title: fp.Title, Sections: []indexSection{{}}}
+	add(0, fp.Title)
+
+	section := 0
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			add(section, n.Data)
+			return
+		case html.ElementNode:
+			switch {
+			case n.Data == "head" || n.Data == "script" || n.Data == "style" || n.Data == "template":
+				return
+			case headingElements[n.Data] && n.Namespace == "":
+				text := htmlpage.CollapseSpace(htmlpage.NodeText(n))
+				page.Sections = append(page.Sections, indexSection{Anchor: headingAnchor(n), Heading: text})
+				section = len(page.Sections) - 1
+				add(section, text)
+				return
+			case n.Data == "p" && page.Snippet == "":
+				page.Snippet = snippet(htmlpage.CollapseSpace(htmlpage.NodeText(n)))
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return
+}
+
+// headingAnchor returns the fragment that links to heading n: its own id, or
+// that of an <a name> or element with an id inside it.
+func headingAnchor(n *html.Node) string {
+	if id := htmlpage.Attr(n, "id"); id != "" {
+		return id
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		if id := htmlpage.Attr(c, "id"); id != "" {
+			return id
+		}
+		if name := htmlpage.Attr(c, "name"); c.Data == "a" && name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// snippet shortens text to about snippetLength characters at a word
+// boundary.
+func snippet(text string) string {
+	r := []rune(text)
+	if len(r) <= snippetLength {
+		return text
+	}
+	cut := snippetLength
+	for cut > snippetLength/2 && !unicode.IsSpace(r[cut]) {
+		cut--
+	}
+	return strings.TrimSpace(string(r[:cut])) + "…"
+}
+
+// searchTerms splits text into lower-case words, drops stop words and
+// single characters other than digits, and stems the rest.
+func searchTerms(text string) (terms []string) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		if stopWords[w] {
+			continue
+		}
+		if len([]rune(w)) < 2 && !unicode.IsDigit([]rune(w)[0]) {
+			continue
+		}
+		terms = append(terms, porterStem(w))
+	}
+	return
+}
+
+// writeSearchIndex writes idx as compact JSON to filename.
+func writeSearchIndex(filename string, idx *searchIndex) (err error) {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+// sendSearchIndex uploads idx as the single item id of the search index
+// table.
+func sendSearchIndex(ctx context.Context, idx *searchIndex, id string) (err error) {
+	url, err := doGetLoadURL("searchindex")
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return
+	}
+	payload, err := json.Marshal(searchIndexItem{ID: id, IndexJson: string(data)})
+	if err != nil {
+		return
+	}
+	return apiUpsert(ctx, url, string(payload))
+}
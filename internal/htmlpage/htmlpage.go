@@ -0,0 +1,111 @@
+// Package htmlpage turns an HTML page into a hb.Fullpage, the same way for
+// every hbctrl command, and holds the small HTML helpers that go with it.
+package htmlpage
+
+import (
+	"fmt"
+	"strings"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"golang.org/x/net/html"
+)
+
+// Options configures how a page is read.
+type Options struct {
+	// DefaultTitle is used when a page has neither a <title> nor an <h1>.
+	DefaultTitle string
+	// MetaID takes the ID from <meta name="hb-id"> when the page has one.
+	MetaID bool
+}
+
+// Fullpage returns the Fullpage for the HTML content, with the ID id unless
+// opts.MetaID finds another. The title is the first non-empty <title>, else
+// the first <h1>, else opts.DefaultTitle. Warnings describe the fallbacks
+// taken.
+func Fullpage(id string, content string, opts Options) (fp hb.Fullpage, warnings []string, err error) {
+	fp.ID = id
+	fp.Content = content
+	z, err := html.Parse(strings.NewReader(fp.Content))
+	if err != nil {
+		return
+	}
+
+	var titles []string
+	var h1 string
+	var metaID string
+	var ff func(*html.Node)
+	ff = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Namespace == "" {
+			switch n.Data {
+			case "meta":
+				if metaID == "" && Attr(n, "name") == "hb-id" {
+					metaID = strings.TrimSpace(Attr(n, "content"))
+				}
+			case "title":
+				titles = append(titles, CollapseSpace(NodeText(n)))
+			case "h1":
+				if h1 == "" {
+					h1 = CollapseSpace(NodeText(n))
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			ff(c)
+		}
+	}
+
+	ff(z)
+
+	if opts.MetaID {
+		if metaID != "" {
+			fp.ID = metaID
+		} else {
+			warnings = append(warnings, fmt.Sprintf("no <meta name=\"hb-id\">, using ID %v", id))
+		}
+	}
+
+	if len(titles) > 1 {
+		warnings = append(warnings, fmt.Sprintf("%v <title> elements, using the first", len(titles)))
+	}
+
+	switch {
+	case len(titles) > 0 && titles[0] != "":
+		fp.Title = titles[0]
+	case h1 != "":
+		fp.Title = h1
+		warnings = append(warnings, "no usable <title>, using first <h1>")
+	case opts.DefaultTitle != "":
+		fp.Title = opts.DefaultTitle
+		warnings = append(warnings, "no usable <title> or <h1>, using default title")
+	default:
+		warnings = append(warnings, "no usable <title> or <h1>, title is empty")
+	}
+	return
+}
+
+// NodeText returns the concatenated text of n and its descendants.
+func NodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(NodeText(c))
+	}
+	return b.String()
+}
+
+// CollapseSpace trims s and replaces each run of whitespace with one space.
+func CollapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Attr returns the value of n's attribute key, or "" if it has none.
+func Attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,55 @@
+package htmlpage
+
+import "testing"
+
+func TestFullpageTitle(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		opts     Options
+		id       string
+		title    string
+		warnings int
+	}{
+		{"title", "<html><head><title> Asthma \n in Children </title></head><body></body></html>", Options{}, "p1", "Asthma in Children", 0},
+		{"empty title", "<html><head><title></title></head><body><p>x</p></body></html>", Options{}, "p1", "", 1},
+		{"empty title with h1", "<html><head><title></title></head><body><h1>Croup</h1><h1>Other</h1></body></html>", Options{}, "p1", "Croup", 1},
+		{"no head", "<body><p>No heading</p></body>", Options{}, "p1", "", 1},
+		{"no head with h1", "<h1> Croup </h1><p>text</p>", Options{}, "p1", "Croup", 1},
+		{"empty document", "", Options{}, "p1", "", 1},
+		{"default title", "<body><p>x</p></body>", Options{DefaultTitle: "Untitled"}, "p1", "Untitled", 1},
+		{"two titles", "<head><title>First</title><title>Second</title></head>", Options{}, "p1", "First", 1},
+		{"meta id", `<head><meta name="hb-id" content=" A001 "><title>T</title></head>`, Options{MetaID: true}, "A001", "T", 0},
+		{"meta id missing", "<head><title>T</title></head>", Options{MetaID: true}, "p1", "T", 1},
+		{"meta id ignored", `<head><meta name="hb-id" content="A001"><title>T</title></head>`, Options{}, "p1", "T", 0},
+	}
+	for _, tt := range tests {
+		fp, warnings, err := Fullpage("p1", tt.content, tt.opts)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if fp.ID != tt.id || fp.Title != tt.title || len(warnings) != tt.warnings {
+			t.Errorf("%v: got ID %q, title %q, warnings %q; want %q, %q, %v warnings", tt.name, fp.ID, fp.Title, warnings, tt.id, tt.title, tt.warnings)
+		}
+		if fp.Content != tt.content {
+			t.Errorf("%v: content changed", tt.name)
+		}
+	}
+}
+
+func TestCollapseSpace(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"  \n\t ", ""},
+		{" a  b\n\tc ", "a b c"},
+	}
+	for _, tt := range tests {
+		if got := CollapseSpace(tt.in); got != tt.want {
+			t.Errorf("CollapseSpace(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Package itemid derives item IDs from file names, the same way for every
+// hbctrl command, so that a file loaded by one tool gets the ID another tool
+// expects.
+package itemid
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// FromName derives an item ID from a file name. "ext", or "", strips the
+// extension, "slug" also slugifies the name and "map" looks the file up in
+// idmap, by its name with or without the extension.
+func FromName(name string, strategy string, idmap map[string]string) (id string, err error) {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+
+	switch strategy {
+	case "", "ext":
+		id = base
+	case "slug":
+		id = Slugify(base)
+	case "map":
+		var ok bool
+		id, ok = idmap[name]
+		if !ok {
+			id, ok = idmap[base]
+		}
+		if !ok {
+			err = fmt.Errorf("%v is not in the ID map", name)
+			return
+		}
+	default:
+		err = fmt.Errorf("Not a valid ID strategy: %v", strategy)
+		return
+	}
+
+	if id == "" {
+		err = fmt.Errorf("Cannot derive an ID from %v", name)
+	}
+	return
+}
+
+// Slugify lower-cases s and replaces every run of characters other than
+// letters and digits with a single hyphen.
+func Slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			hyphen = false
+			continue
+		}
+		if !hyphen && b.Len() > 0 {
+			b.WriteByte('-')
+			hyphen = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// ReadMap reads a JSON object mapping file names, with or without their
+// extension, to IDs.
+func ReadMap(filename string) (idmap map[string]string, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &idmap)
+	return
+}
+
+// Duplicates describes every ID that more than one file maps to. ids[i] is
+// the ID of the file names[i]; files with no ID are ignored.
+func Duplicates(ids []string, names []string) (dups []string) {
+	byID := map[string][]string{}
+	var order []string
+	for i, id := range ids {
+		if id == "" {
+			continue
+		}
+		if _, ok := byID[id]; !ok {
+			order = append(order, id)
+		}
+		byID[id] = append(byID[id], names[i])
+	}
+	for _, id := range order {
+		if len(byID[id]) > 1 {
+			dups = append(dups, fmt.Sprintf("%v from %v", id, strings.Join(byID[id], ", ")))
+		}
+	}
+	return
+}
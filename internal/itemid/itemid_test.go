@@ -0,0 +1,69 @@
+package itemid
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Asthma", "asthma"},
+		{"Asthma in Children", "asthma-in-children"},
+		{"  Acute -- Otitis   Media ", "acute-otitis-media"},
+		{"COVID-19 (2020)", "covid-19-2020"},
+		{"Fièvre_Aiguë", "fièvre-aiguë"},
+		{"...", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Slugify(tt.in); got != tt.want {
+			t.Errorf("Slugify(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFromName(t *testing.T) {
+	idmap := map[string]string{"asthma.json": "A001", "croup": "C002"}
+	tests := []struct {
+		name     string
+		strategy string
+		want     string
+		err      bool
+	}{
+		{"asthma.json", "", "asthma", false},
+		{"Asthma In Children.json", "ext", "Asthma In Children", false},
+		{"Asthma In Children.json", "slug", "asthma-in-children", false},
+		{"asthma.json", "map", "A001", false},
+		{"croup.json", "map", "C002", false},
+		{"otitis.json", "map", "", true},
+		{"---.json", "slug", "", true},
+		{".json", "ext", "", true},
+		{"asthma.json", "meta", "", true},
+		{"asthma.json", "guess", "", true},
+	}
+	for _, tt := range tests {
+		got, err := FromName(tt.name, tt.strategy, idmap)
+		if (err != nil) != tt.err {
+			t.Errorf("FromName(%q, %q) error = %v, want error %v", tt.name, tt.strategy, err, tt.err)
+			continue
+		}
+		if !tt.err && got != tt.want {
+			t.Errorf("FromName(%q, %q) = %q, want %q", tt.name, tt.strategy, got, tt.want)
+		}
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	ids := []string{"b", "a", "a", "", "", "b", "c"}
+	names := []string{"b.html", "a.html", "A.htm", "empty.html", "also-empty.html", "b.md", "c.html"}
+	want := []string{"b from b.html, b.md", "a from a.html, A.htm"}
+	if got := Duplicates(ids, names); !reflect.DeepEqual(got, want) {
+		t.Errorf("Duplicates() = %q, want %q", got, want)
+	}
+	if got := Duplicates(ids[:2], names[:2]); got != nil {
+		t.Errorf("Duplicates() of distinct IDs = %q, want none", got)
+	}
+}
@@ -0,0 +1,47 @@
+// Package run holds what the hbctrl commands share for long runs against the
+// server: stopping cleanly on a signal, state files for resuming an
+// interrupted run, and a progress display.
+package run
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// InterruptContexts returns two contexts driven by SIGINT and SIGTERM. The
+// first signal cancels stop, so no new request is started but the one in
+// flight may finish. The second signal cancels abort, which abandons the
+// request in flight. abort is the parent of stop.
+func InterruptContexts() (stop context.Context, abort context.Context, release func()) {
+	abort, cancelAbort := context.WithCancel(context.Background())
+	stop, cancelStop := context.WithCancel(abort)
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case s := <-sigs:
+			log.Printf("Received %v, finishing current request. Repeat to abort it.\n", s)
+			cancelStop()
+		case <-abort.Done():
+			return
+		}
+		select {
+		case s := <-sigs:
+			log.Printf("Received %v, abandoning current request.\n", s)
+			cancelAbort()
+		case <-abort.Done():
+		}
+	}()
+
+	release = func() {
+		signal.Stop(sigs)
+		cancelStop()
+		cancelAbort()
+	}
+	return
+}
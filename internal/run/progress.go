@@ -0,0 +1,131 @@
+package run
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Progress reports how far a long operation has got. On a terminal it
+// redraws a single status line; otherwise it prints a plain line every
+// logInterval so CI logs stay readable.
+type Progress struct {
+	label     string
+	total     int
+	done      int
+	startDone int
+	errors    int
+	start     time.Time
+	last      time.Time
+	tty       bool
+	quiet     bool
+	out       io.Writer
+}
+
+const (
+	redrawInterval = 200 * time.Millisecond
+	logInterval    = 10 * time.Second
+)
+
+// NewProgress starts a progress display for total items, done of which were
+// already completed by an earlier run. A total of 0 means not yet known.
+func NewProgress(label string, total int, done int, quiet bool) *Progress {
+	return &Progress{
+		label:     label,
+		total:     total,
+		done:      done,
+		startDone: done,
+		start:     time.Now(),
+		tty:       IsTerminal(os.Stdout),
+		quiet:     quiet,
+		out:       os.Stdout,
+	}
+}
+
+// IsTerminal reports whether f is a character device such as a TTY.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Drawing reports whether the display owns the current terminal line, in
+// which case other per-item output should be suppressed.
+func (p *Progress) Drawing() bool {
+	return !p.quiet && p.tty
+}
+
+// SetTotal sets the number of items, once it is known.
+func (p *Progress) SetTotal(total int) {
+	p.total = total
+	p.print(false)
+}
+
+// Add records n more items done.
+func (p *Progress) Add(n int) {
+	p.done += n
+	p.print(false)
+}
+
+// Fail records an item that failed.
+func (p *Progress) Fail() {
+	p.errors++
+	p.print(false)
+}
+
+// Finish prints the final state and, on a terminal, ends the status line.
+func (p *Progress) Finish() {
+	p.print(true)
+	if p.Drawing() {
+		fmt.Fprintln(p.out)
+	}
+}
+
+func (p *Progress) print(force bool) {
+	if p.quiet {
+		return
+	}
+
+	now := time.Now()
+	interval := logInterval
+	if p.tty {
+		interval = redrawInterval
+	}
+	if !force && now.Sub(p.last) < interval {
+		return
+	}
+	p.last = now
+
+	line := p.String()
+	if p.tty {
+		fmt.Fprintf(p.out, "\r\033[K%s", line)
+	} else {
+		fmt.Fprintln(p.out, line)
+	}
+}
+
+func (p *Progress) String() string {
+	elapsed := time.Since(p.start)
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.done-p.startDone) / elapsed.Seconds()
+	}
+
+	counts := fmt.Sprintf("%v", p.done)
+	eta := "?"
+	if p.total > 0 {
+		counts = fmt.Sprintf("%v/%v (%.1f%%)", p.done, p.total, 100*float64(p.done)/float64(p.total))
+		if rate > 0 {
+			remaining := time.Duration(float64(p.total-p.done)/rate) * time.Second
+			if remaining < 0 {
+				remaining = 0
+			}
+			eta = remaining.Round(time.Second).String()
+		}
+	}
+
+	return fmt.Sprintf("%s: %s  %.1f/s  errors: %v  ETA %s", p.label, counts, rate, p.errors, eta)
+}
@@ -0,0 +1,102 @@
+package run
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// LoadState records which files of a directory load have been sent, so an
+// interrupted run can be resumed without re-sending them. Target is where
+// they are sent, a table name or URL; a state file for another directory or
+// target is not resumed from.
+type LoadState struct {
+	Dir    string          `json:"dir"`
+	Target string          `json:"target"`
+	Done   map[string]bool `json:"done"`
+	// Assets records, by asset ID, the assets sent along with the files.
+	// They are kept apart from Done so that they are not counted as files.
+	Assets map[string]bool `json:"assets,omitempty"`
+}
+
+// Sent returns how many of names are done.
+func (st LoadState) Sent(names []string) (n int) {
+	for _, name := range names {
+		if st.Done[name] {
+			n++
+		}
+	}
+	return
+}
+
+// ReadLoadState returns the state of an earlier load of dir to target kept
+// in filename, or an empty state when there is none. A filename of "" keeps
+// no state.
+func ReadLoadState(filename string, dir string, target string) (st LoadState, err error) {
+	st = LoadState{Dir: dir, Target: target, Done: map[string]bool{}, Assets: map[string]bool{}}
+	if filename == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return
+	}
+
+	var prev LoadState
+	err = json.Unmarshal(data, &prev)
+	if err != nil {
+		return
+	}
+	if prev.Dir != dir || prev.Target != target {
+		log.Printf("State file %v is for %v (%v), starting over\n", filename, prev.Dir, prev.Target)
+		return
+	}
+	if prev.Done != nil {
+		st.Done = prev.Done
+	}
+	if prev.Assets != nil {
+		st.Assets = prev.Assets
+	}
+	log.Printf("Resuming from %v\n", filename)
+	return
+}
+
+// WriteLoadState records st in filename.
+func WriteLoadState(filename string, st LoadState) (err error) {
+	if filename == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return
+	}
+	return WriteFile(filename, data)
+}
+
+// RemoveLoadState removes the state file of a load that has finished.
+func RemoveLoadState(filename string) {
+	if filename == "" {
+		return
+	}
+	err := os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Cannot remove state file: %v\n", err)
+	}
+}
+
+// WriteFile replaces filename with data through a rename, so that a crash
+// while writing cannot leave a truncated file behind.
+func WriteFile(filename string, data []byte) (err error) {
+	tmp := filename + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// layoutPage is the data passed to a page layout.
+type layoutPage struct {
+	ID           string
+	Title        string
+	Section      string
+	HandbookType string
+	// BuildDate is the day of the load, as YYYY-MM-DD.
+	BuildDate string
+	// Meta holds the front matter fields.
+	Meta map[string]string
+	Body template.HTML
+}
+
+// layoutSet holds the layouts body fragments are rendered into. It is read
+// from a single template file, or from a directory of templates named
+// <name>.html, where the name is chosen per page by its "layout" front
+// matter key, then by the handbook type, then "default".
+type layoutSet struct {
+	single *template.Template
+	named  map[string]*template.Template
+}
+
+// readLayouts reads the layout file or directory at path.
+func readLayouts(path string) (ls *layoutSet, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	if !info.IsDir() {
+		var data []byte
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return
+		}
+		ls = &layoutSet{}
+		ls.single, err = template.New(filepath.Base(path)).Parse(string(data))
+		return
+	}
+
+	names, err := filepath.Glob(filepath.Join(path, "*.html"))
+	if err != nil {
+		return
+	}
+	ls = &layoutSet{named: map[string]*template.Template{}}
+	for _, filename := range names {
+		var data []byte
+		data, err = ioutil.ReadFile(filename)
+		if err != nil {
+			return
+		}
+		name := strings.TrimSuffix(filepath.Base(filename), ".html")
+		ls.named[name], err = template.New(name).Parse(string(data))
+		if err != nil {
+			return
+		}
+	}
+	if len(ls.named) == 0 {
+		err = fmt.Errorf("no *.html layouts in %v", path)
+	}
+	return
+}
+
+// lookup returns the first layout found among names.
+func (ls *layoutSet) lookup(names ...string) (*template.Template, error) {
+	if ls.single != nil {
+		return ls.single, nil
+	}
+	var tried []string
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if t, ok := ls.named[name]; ok {
+			return t, nil
+		}
+		tried = append(tried, name+".html")
+	}
+	return nil, fmt.Errorf("none of %v found", strings.Join(tried, ", "))
+}
+
+// isFragment reports whether content is a body fragment: HTML with no
+// doctype and no <html>, <head> or <body> tag.
+func isFragment(content string) bool {
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return true
+		case html.DoctypeToken:
+			return false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "html", "head", "body":
+				return false
+			}
+		}
+	}
+}
+
+// wrapFragment renders a body fragment into its layout. The title is the
+// front matter "title", else the first <h1> of the fragment, else
+// opts.DefaultTitle.
+func wrapFragment(id string, content string, fields map[string]string, opts fullpageOptions) (page string, err error) {
+	handbookType := opts.HandbookType
+	if v := fields["handbook-type"]; v != "" {
+		handbookType = v
+	}
+	t, err := opts.Layouts.lookup(fields["layout"], handbookType, "default")
+	if err != nil {
+		return
+	}
+
+	data := layoutPage{
+		ID:           id,
+		Title:        fields["title"],
+		Section:      fields["section"],
+		HandbookType: handbookType,
+		BuildDate:    opts.BuildDate,
+		Meta:         fields,
+		Body:         template.HTML(content),
+	}
+	if data.Title == "" {
+		data.Title = fragmentHeading(content)
+	}
+	if data.Title == "" {
+		data.Title = opts.DefaultTitle
+	}
+
+	var b bytes.Buffer
+	err = t.Execute(&b, data)
+	if err != nil {
+		return
+	}
+	return b.String(), nil
+}
+
+// fragmentHeading returns the text of the first <h1> in a fragment.
+func fragmentHeading(content string) string {
+	nodes, err := html.ParseFragment(strings.NewReader(content), &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return ""
+	}
+	var find func(*html.Node) string
+	find = func(n *html.Node) string {
+		if n.Type == html.ElementNode && n.Data == "h1" {
+			return htmlpage.CollapseSpace(htmlpage.NodeText(n))
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if t := find(c); t != "" {
+				return t
+			}
+		}
+		return ""
+	}
+	for _, n := range nodes {
+		if t := find(n); t != "" {
+			return t
+		}
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsFragment(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"", true},
+		{"<h1>Croup</h1><p>Barking cough</p>", true},
+		{"<!-- note --><p>x</p>", true},
+		{"<!DOCTYPE html><p>x</p>", false},
+		{"<html><p>x</p></html>", false},
+		{"<p>x</p><body>y</body>", false},
+		{"<head><title>T</title></head>", false},
+	}
+	for _, tt := range tests {
+		if got := isFragment(tt.content); got != tt.want {
+			t.Errorf("isFragment(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestWrapFragment(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"default.html": "default|{{.ID}}|{{.Title}}|{{.HandbookType}}|{{.BuildDate}}|{{.Body}}",
+		"peds.html":    "peds|{{.Title}}|{{.Section}}|{{index .Meta \"author\"}}",
+		"wide.html":    "wide|{{.Title}}",
+		"ignored.tmpl": "{{",
+	} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ls, err := readLayouts(dir)
+	if err != nil {
+		t.Fatalf("readLayouts() error = %v", err)
+	}
+
+	opts := fullpageOptions{Layouts: ls, HandbookType: "adult", BuildDate: "2020-01-02", DefaultTitle: "Untitled"}
+	tests := []struct {
+		name    string
+		content string
+		fields  map[string]string
+		want    string
+	}{
+		{"default", "<h1> Croup </h1>", nil, "default|p1|Croup|adult|2020-01-02|<h1> Croup </h1>"},
+		{"default title", "<p>x</p>", nil, "default|p1|Untitled|adult|2020-01-02|<p>x</p>"},
+		{"front matter title", "<h1>Croup</h1>", map[string]string{"title": "Croup &amp; Cough"}, "default|p1|Croup &amp;amp; Cough|adult|2020-01-02|<h1>Croup</h1>"},
+		{"handbook type", "", map[string]string{"handbook-type": "peds", "title": "T", "section": "S", "author": "A"}, "peds|T|S|A"},
+		{"layout key", "", map[string]string{"handbook-type": "peds", "layout": "wide", "title": "T"}, "wide|T"},
+		{"unknown layout", "", map[string]string{"layout": "narrow", "title": "T"}, "default|p1|T|adult|2020-01-02|"},
+	}
+	for _, tt := range tests {
+		got, err := wrapFragment("p1", tt.content, tt.fields, opts)
+		if err != nil || got != tt.want {
+			t.Errorf("%v: wrapFragment() = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	delete(ls.named, "default")
+	if _, err = wrapFragment("p1", "", nil, opts); err == nil {
+		t.Errorf("wrapFragment() with no matching layout returned no error")
+	}
+}
+
+func TestReadLayoutsFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "page.tmpl")
+	err := ioutil.WriteFile(name, []byte("{{.Title}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := readLayouts(name)
+	if err != nil {
+		t.Fatalf("readLayouts() error = %v", err)
+	}
+	got, err := wrapFragment("p1", "", map[string]string{"layout": "other", "title": "T"}, fullpageOptions{Layouts: ls})
+	if err != nil || got != "T" {
+		t.Errorf("wrapFragment() with a single layout = %q, %v; want %q", got, err, "T")
+	}
+
+	if _, err = readLayouts(t.TempDir()); err == nil {
+		t.Errorf("readLayouts() of a directory with no layouts returned no error")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"golang.org/x/net/html"
+)
+
+// linkPages checks the <a href> links between the pages of a load. Relative
+// links are resolved against the linking page's path within the load and
+// rewritten to opts.LinkPrefix + the target Fullpage ID, keeping any
+// fragment. A link to a page that was split goes to the piece holding the
+// fragment, or the first piece when there is none. Links to files that are
+// not pages of the load, and fragments that name no anchor in the target,
+// are reported as warnings on the linking item. In "fail" mode an error is
+// returned when any are found.
+func linkPages(items []loadItem, opts fullpageOptions) (err error) {
+	switch opts.Links {
+	case "", "off":
+		return
+	case "warn", "fail":
+	default:
+		return fmt.Errorf("Not a valid links mode: %v", opts.Links)
+	}
+
+	ids := map[string][]string{}
+	anchors := map[string]map[string]bool{}
+	docs := make([]*html.Node, len(items))
+	for i, item := range items {
+		if item.Page == nil {
+			continue
+		}
+		docs[i], err = html.Parse(strings.NewReader(item.Page.Content))
+		if err != nil {
+			return
+		}
+		ids[item.source()] = append(ids[item.source()], item.Page.ID)
+		anchors[item.Page.ID] = pageAnchors(docs[i])
+	}
+
+	broken := 0
+	for i := range items {
+		item := &items[i]
+		if item.Page == nil {
+			continue
+		}
+
+		changed := false
+		var walk func(*html.Node)
+		walk = func(n *html.Node) {
+			if n.Type == html.ElementNode && n.Data == "a" && n.Namespace == "" {
+				href := strings.TrimSpace(htmlpage.Attr(n, "href"))
+				target, ok, problem := resolveLink(href, item.source(), ids, anchors, item.Page.ID)
+				if problem != "" {
+					item.Warnings = append(item.Warnings, "links: "+problem)
+					broken++
+				}
+				if ok {
+					setAttr(n, "href", opts.LinkPrefix+target)
+					changed = true
+				}
+			}
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				walk(c)
+			}
+		}
+		walk(docs[i])
+
+		if changed {
+			var b bytes.Buffer
+			err = html.Render(&b, docs[i])
+			if err != nil {
+				return
+			}
+			item.Page.Content = b.String()
+		}
+	}
+
+	if opts.Links == "fail" && broken > 0 {
+		err = fmt.Errorf("%v broken links", broken)
+	}
+	return
+}
+
+// resolveLink resolves href as written on the page at name. It returns the
+// target as "ID" or "ID#fragment" when the link should be rewritten, and a
+// description of the problem when the link is broken. External links and
+// links within the same page are not rewritten.
+func resolveLink(href string, name string, ids map[string][]string, anchors map[string]map[string]bool, self string) (target string, ok bool, problem string) {
+	if href == "" || strings.HasPrefix(href, "//") || urlScheme(href) != "" {
+		return
+	}
+	u, err := url.Parse(href)
+	if err != nil {
+		problem = fmt.Sprintf("cannot parse %q: %v", href, err)
+		return
+	}
+
+	if u.Path == "" {
+		if u.Fragment != "" && !anchors[self][u.Fragment] {
+			problem = fmt.Sprintf("%q: no anchor %q in this page", href, u.Fragment)
+		}
+		return
+	}
+
+	p := u.Path
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(path.Dir(name), p)
+	}
+	p = strings.TrimPrefix(path.Clean(p), "/")
+
+	pieces, found := ids[p]
+	if !found {
+		problem = fmt.Sprintf("%q: %v is not a page in this load", href, p)
+		return
+	}
+
+	target = pieces[0]
+	if u.Fragment != "" {
+		problem = fmt.Sprintf("%q: no anchor %q in %v", href, u.Fragment, p)
+		for _, id := range pieces {
+			if anchors[id][u.Fragment] {
+				target, problem = id, ""
+				break
+			}
+		}
+		target += "#" + u.Fragment
+	}
+	ok = true
+	return
+}
+
+// pageAnchors returns the fragment names a page defines, from id attributes
+// and <a name>.
+func pageAnchors(doc *html.Node) map[string]bool {
+	anchors := map[string]bool{}
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if id := htmlpage.Attr(n, "id"); id != "" {
+				anchors[id] = true
+			}
+			if n.Data == "a" {
+				if name := htmlpage.Attr(n, "name"); name != "" {
+					anchors[name] = true
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return anchors
+}
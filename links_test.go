@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+)
+
+func TestResolveLink(t *testing.T) {
+	ids := map[string][]string{
+		"asthma.html":      {"asthma"},
+		"peds/croup.html":  {"croup", "croup-treatment"},
+		"peds/otitis.html": {"otitis"},
+	}
+	anchors := map[string]map[string]bool{
+		"asthma":          {"top": true},
+		"croup":           {"signs": true},
+		"croup-treatment": {"steroids": true},
+		"otitis":          {},
+	}
+	tests := []struct {
+		href    string
+		name    string
+		self    string
+		target  string
+		ok      bool
+		problem bool
+	}{
+		{"https://example.org/a.html", "asthma.html", "asthma", "", false, false},
+		{"//example.org/a.html", "asthma.html", "asthma", "", false, false},
+		{"mailto:a@example.org", "asthma.html", "asthma", "", false, false},
+		{"", "asthma.html", "asthma", "", false, false},
+		{"#top", "asthma.html", "asthma", "", false, false},
+		{"#bottom", "asthma.html", "asthma", "", false, true},
+		{"peds/croup.html", "asthma.html", "asthma", "croup", true, false},
+		{"otitis.html", "peds/croup.html", "croup", "otitis", true, false},
+		{"../asthma.html#top", "peds/otitis.html", "otitis", "asthma#top", true, false},
+		{"/asthma.html", "peds/otitis.html", "otitis", "asthma", true, false},
+		{"./croup.html#steroids", "peds/otitis.html", "otitis", "croup-treatment#steroids", true, false},
+		{"croup.html#signs", "peds/otitis.html", "otitis", "croup#signs", true, false},
+		{"croup.html#missing", "peds/otitis.html", "otitis", "croup#missing", true, true},
+		{"missing.html", "asthma.html", "asthma", "", false, true},
+		{"%zz.html", "asthma.html", "asthma", "", false, true},
+	}
+	for _, tt := range tests {
+		target, ok, problem := resolveLink(tt.href, tt.name, ids, anchors, tt.self)
+		if target != tt.target || ok != tt.ok || (problem != "") != tt.problem {
+			t.Errorf("resolveLink(%q, %q) = %q, %v, %q; want %q, %v, problem %v", tt.href, tt.name, target, ok, problem, tt.target, tt.ok, tt.problem)
+		}
+	}
+}
+
+func TestLinkPages(t *testing.T) {
+	items := func() []loadItem {
+		return []loadItem{
+			{Name: "a.html", Page: &hb.Fullpage{ID: "A1", Content: `<p><a href="b.html#x">b</a> <a href="https://example.org/">ext</a></p>`}},
+			{Name: "b.html", Page: &hb.Fullpage{ID: "B2", Content: `<p id="x"><a href="gone.html">gone</a></p>`}},
+			{Name: "c.json", JS: "{}"},
+		}
+	}
+
+	got := items()
+	if err := linkPages(got, fullpageOptions{Links: "warn", LinkPrefix: "hb://"}); err != nil {
+		t.Fatalf("linkPages(warn) error = %v", err)
+	}
+	if !strings.Contains(got[0].Page.Content, `href="hb://B2#x"`) {
+		t.Errorf("link to b.html not rewritten: %v", got[0].Page.Content)
+	}
+	if !strings.Contains(got[0].Page.Content, `href="https://example.org/"`) {
+		t.Errorf("external link changed: %v", got[0].Page.Content)
+	}
+	if len(got[0].Warnings) != 0 || len(got[1].Warnings) != 1 {
+		t.Errorf("warnings = %q, %q; want none on a.html and one on b.html", got[0].Warnings, got[1].Warnings)
+	}
+
+	if err := linkPages(items(), fullpageOptions{Links: "fail"}); err == nil {
+		t.Errorf("linkPages(fail) with a broken link returned no error")
+	}
+
+	got = items()
+	if err := linkPages(got, fullpageOptions{}); err != nil || got[0].Page.Content != items()[0].Page.Content {
+		t.Errorf("linkPages(off) changed the page or failed: %v", err)
+	}
+
+	if err := linkPages(items(), fullpageOptions{Links: "maybe"}); err == nil {
+		t.Errorf("linkPages with an invalid mode returned no error")
+	}
+}
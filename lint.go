@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"golang.org/x/net/html"
+)
+
+// lintDiag is one accessibility problem found in a page.
+type lintDiag struct {
+	Name    string
+	Line    int
+	Col     int
+	Rule    string
+	Message string
+}
+
+func (d lintDiag) String() string {
+	return fmt.Sprintf("%v:%v:%v: %v: %v", d.Name, d.Line, d.Col, d.Rule, d.Message)
+}
+
+// vagueLinkText is link text that says nothing about where the link goes
+// when it is read out of context, as screen readers list links.
+var vagueLinkText = stringSet([]string{
+	"click", "click here", "go", "here", "learn more", "link", "more",
+	"more info", "read more", "see more", "this", "this link", "this page",
+})
+
+// openLink is an <a href> whose text is being collected.
+type openLink struct {
+	line, col int
+	text      strings.Builder
+	// labelled is set by an aria-label or an image with alt text.
+	labelled bool
+}
+
+// openTable counts the header cells of a <table>. Tables marked as layout
+// with role="presentation" or role="none" need none.
+type openTable struct {
+	line, col int
+	headers   int
+	layout    bool
+}
+
+// positions converts byte offsets in a file into line and column numbers.
+type positions struct {
+	src []byte
+	// lineStarts holds the offset of the first byte of every line.
+	lineStarts []int
+	// firstLine is the number of the first line of src in the file.
+	firstLine int
+}
+
+func newPositions(src []byte, firstLine int) *positions {
+	p := &positions{src: src, lineStarts: []int{0}, firstLine: firstLine}
+	for i, b := range src {
+		if b == '\n' {
+			p.lineStarts = append(p.lineStarts, i+1)
+		}
+	}
+	return p
+}
+
+// at returns the line and column, counted in characters, of offset.
+func (p *positions) at(offset int) (line int, col int) {
+	i := sort.Search(len(p.lineStarts), func(i int) bool { return p.lineStarts[i] > offset }) - 1
+	return p.firstLine + i, utf8.RuneCount(p.src[p.lineStarts[i]:offset]) + 1
+}
+
+// lintHTML checks one HTML file for images without alt text, skipped
+// heading levels, tables without header cells, empty links, link text that
+// means nothing out of context and a missing document language.
+func lintHTML(name string, content []byte) (diags []lintDiag) {
+	// Line numbers count the front matter lines too.
+	_, rest := splitFrontMatter(string(content))
+	firstLine := 1 + strings.Count(string(content[:len(content)-len(rest)]), "\n")
+	pos := newPositions([]byte(rest), firstLine)
+
+	report := func(line, col int, rule, format string, args ...interface{}) {
+		diags = append(diags, lintDiag{Name: name, Line: line, Col: col, Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	var links []*openLink
+	var tables []*openTable
+	lastHeading := 0
+	sawHTML := false
+
+	z := html.NewTokenizer(strings.NewReader(rest))
+	offset := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		raw := z.Raw()
+		line, col := pos.at(offset)
+		offset += len(raw)
+
+		switch tt {
+		case html.TextToken:
+			for _, l := range links {
+				l.text.Write(raw)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "html":
+				sawHTML = true
+				if strings.TrimSpace(tokenAttr(t, "lang")) == "" {
+					report(line, col, "html-lang", "<html> has no lang attribute")
+				}
+			case "img":
+				alt, ok := tokenAttrOK(t, "alt")
+				if !ok {
+					report(line, col, "img-alt", "<img> has no alt attribute; use alt=\"\" for decorative images")
+				}
+				if strings.TrimSpace(alt) != "" {
+					for _, l := range links {
+						l.labelled = true
+					}
+				}
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				level := int(t.Data[1] - '0')
+				if lastHeading > 0 && level > lastHeading+1 {
+					report(line, col, "heading-order", "<%v> follows <h%v>, skipping a level", t.Data, lastHeading)
+				}
+				lastHeading = level
+			case "table":
+				if tt == html.StartTagToken {
+					role := strings.ToLower(strings.TrimSpace(tokenAttr(t, "role")))
+					tables = append(tables, &openTable{line: line, col: col, layout: role == "presentation" || role == "none"})
+				}
+			case "th":
+				if len(tables) > 0 {
+					tables[len(tables)-1].headers++
+				}
+			case "a":
+				if _, ok := tokenAttrOK(t, "href"); ok && tt == html.StartTagToken {
+					l := &openLink{line: line, col: col}
+					l.labelled = strings.TrimSpace(tokenAttr(t, "aria-label")) != ""
+					links = append(links, l)
+				}
+			}
+		case html.EndTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "table":
+				if n := len(tables); n > 0 {
+					if tables[n-1].headers == 0 && !tables[n-1].layout {
+						report(tables[n-1].line, tables[n-1].col, "table-headers", "<table> has no <th> header cells")
+					}
+					tables = tables[:n-1]
+				}
+			case "a":
+				if n := len(links); n > 0 {
+					l := links[n-1]
+					links = links[:n-1]
+					text := htmlpage.CollapseSpace(html.UnescapeString(l.text.String()))
+					switch {
+					case l.labelled:
+					case text == "":
+						report(l.line, l.col, "link-empty", "link has no text")
+					case vagueLinkText[strings.ToLower(strings.TrimFunc(text, unicode.IsPunct))]:
+						report(l.line, l.col, "link-text", "link text %q does not say where the link goes", text)
+					}
+				}
+			}
+		}
+	}
+
+	if !sawHTML {
+		report(firstLine, 1, "html-lang", "document has no <html lang> element")
+	}
+	return
+}
+
+func tokenAttr(t html.Token, key string) string {
+	val, _ := tokenAttrOK(t, key)
+	return val
+}
+
+func tokenAttrOK(t html.Token, key string) (string, bool) {
+	for _, a := range t.Attr {
+		if a.Key == key && a.Namespace == "" {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// lintFiles lints filename, or every HTML file under it when indir is set,
+// writing the diagnostics to w. It returns the number of problems found.
+func lintFiles(filename string, indir bool, w io.Writer) (problems int, err error) {
+	var names []string
+	if indir {
+		err = filepath.Walk(filename, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != filename && strings.HasPrefix(info.Name(), ".") {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.IsDir() && hasExtension(info.Name(), inputExtensions["html"]) {
+				names = append(names, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	} else {
+		names = []string{filename}
+	}
+
+	pages := 0
+	for _, path := range names {
+		var content []byte
+		content, err = ioutil.ReadFile(path)
+		if err != nil {
+			return
+		}
+		name := filepath.Base(path)
+		if indir {
+			rel, _ := filepath.Rel(filename, path)
+			name = filepath.ToSlash(rel)
+		}
+
+		diags := lintHTML(name, content)
+		for _, d := range diags {
+			fmt.Fprintln(w, d)
+		}
+		if len(diags) > 0 {
+			pages++
+		}
+		problems += len(diags)
+	}
+	fmt.Fprintf(w, "lint: %v problems in %v of %v pages\n", problems, pages, len(names))
+	return
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPositions(t *testing.T) {
+	src := []byte("ab\n\ncé<img>\n")
+	p := newPositions(src, 5)
+	tests := []struct {
+		offset int
+		line   int
+		col    int
+	}{
+		{0, 5, 1},
+		{2, 5, 3},
+		{3, 6, 1},
+		{4, 7, 1},
+		{5, 7, 2},
+		{7, 7, 3},
+		{12, 7, 8},
+		{13, 8, 1},
+	}
+	for _, tt := range tests {
+		if line, col := p.at(tt.offset); line != tt.line || col != tt.col {
+			t.Errorf("at(%v) = %v:%v, want %v:%v", tt.offset, line, col, tt.line, tt.col)
+		}
+	}
+}
+
+// lintPlaces returns the position and rule of each diagnostic.
+func lintPlaces(diags []lintDiag) (places []string) {
+	for _, d := range diags {
+		places = append(places, lintDiag{Line: d.Line, Col: d.Col, Rule: d.Rule}.String())
+	}
+	return
+}
+
+func TestLintHTML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "clean",
+			content: `<html lang="en"><h1>A</h1><h2>B</h2><img alt=""><a href="x">Asthma plan</a><table><tr><th>H</th></tr></table></html>`,
+		},
+		{
+			name:    "positions",
+			content: "<html lang=\"en\">\n<h1>A</h1>\n  <h3>é</h3><img src=x>\n",
+			want:    []string{":3:3: heading-order: ", ":3:13: img-alt: "},
+		},
+		{
+			name:    "characters not bytes",
+			content: "<html lang=\"fr\"><p>Fièvre aiguë</p><img>",
+			want:    []string{":1:36: img-alt: "},
+		},
+		{
+			name:    "front matter lines counted",
+			content: "---\ntitle: Croup\n---\n<html>\n<a href=\"x\"> </a>",
+			want:    []string{":4:1: html-lang: ", ":5:1: link-empty: "},
+		},
+		{
+			name:    "no html element",
+			content: "---\ntitle: Croup\n---\n<p>x</p>",
+			want:    []string{":4:1: html-lang: "},
+		},
+		{
+			name:    "links",
+			content: `<html lang="en"><a href="x">Click here!</a><a href="y" aria-label="Croup">here</a><a href="z"><img alt="Croup"></a><a name="n"></a>`,
+			want:    []string{":1:17: link-text: "},
+		},
+		{
+			name:    "tables",
+			content: "<html lang=\"en\"><table><tr><td>x</td></tr></table>\n<table role=\"presentation\"><tr><td>x</td></tr></table>",
+			want:    []string{":1:17: table-headers: "},
+		},
+	}
+	for _, tt := range tests {
+		if got := lintPlaces(lintHTML("", []byte(tt.content))); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: lintHTML() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/russross/blackfriday/v2"
+)
+
+// markdownPage is the data passed to the Markdown wrapper template.
+type markdownPage struct {
+	ID    string
+	Title string
+	// Meta holds the front matter fields.
+	Meta map[string]string
+	Body template.HTML
+}
+
+// defaultMarkdownTemplate wraps converted Markdown in a minimal document.
+const defaultMarkdownTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+{{- range $name, $content := .Meta}}
+<meta name="{{$name}}" content="{{$content}}">
+{{- end}}
+</head>
+<body>
+{{.Body}}
+</body>
+</html>
+`
+
+// markdownExtensions enables tables, footnotes and heading anchors on top of
+// the common extensions.
+const markdownExtensions = blackfriday.CommonExtensions | blackfriday.Footnotes | blackfriday.AutoHeadingIDs
+
+// readMarkdownTemplate parses the wrapper template in filename, or the
+// default template when filename is empty.
+func readMarkdownTemplate(filename string) (t *template.Template, err error) {
+	text := defaultMarkdownTemplate
+	if filename != "" {
+		var data []byte
+		data, err = ioutil.ReadFile(filename)
+		if err != nil {
+			return
+		}
+		text = string(data)
+	}
+	return template.New("markdown").Parse(text)
+}
+
+// doLoadMarkdown converts a Markdown file into a Fullpage. The front matter
+// "id" and "title" keys set the ID and title; without them the ID comes from
+// the file name and the title from the first heading.
+func doLoadMarkdown(table string, filename string, opts fullpageOptions) (item loadItem, err error) {
+	if table != "fullpage" {
+		err = errors.New("No table defined")
+		return
+	}
+	if opts.MarkdownTemplate == nil {
+		err = errors.New("No Markdown template")
+		return
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	front, source := splitFrontMatter(string(data))
+	fields, err := parseFrontMatter(front)
+	if err != nil {
+		err = fmt.Errorf("front matter: %v", err)
+		return
+	}
+
+	id := fields["id"]
+	if id == "" {
+		id, err = fullpageID(filepath.Base(filename), opts)
+		if err != nil {
+			return
+		}
+	}
+
+	body := blackfriday.Run([]byte(source), blackfriday.WithExtensions(markdownExtensions))
+
+	meta := map[string]string{}
+	for k, v := range fields {
+		if k != "id" && k != "title" {
+			meta[k] = v
+		}
+	}
+
+	var b bytes.Buffer
+	err = opts.MarkdownTemplate.Execute(&b, markdownPage{
+		ID:    id,
+		Title: fields["title"],
+		Meta:  meta,
+		Body:  template.HTML(body),
+	})
+	if err != nil {
+		return
+	}
+
+	return fullpageItem(filename, id, b.String(), fields, opts)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"golang.org/x/net/html"
+	"gopkg.in/yaml.v2"
+)
+
+// pageMetadata is the structured metadata of one Fullpage, taken from its
+// <meta> tags and YAML front matter.
+type pageMetadata struct {
+	// ID is the ID of the Fullpage the metadata belongs to.
+	ID           string   `json:"id"`
+	Description  string   `json:"description,omitempty"`
+	Keywords     []string `json:"keywords,omitempty"`
+	Section      string   `json:"section,omitempty"`
+	LastReviewed string   `json:"lastReviewed,omitempty"`
+	Author       string   `json:"author,omitempty"`
+	// Extra holds configured fields that have no field of their own.
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+// fullpageWithMetadata is the payload sent in "inline" metadata mode.
+type fullpageWithMetadata struct {
+	hb.Fullpage
+	Metadata *pageMetadata `json:"metadata,omitempty"`
+}
+
+const lastReviewedLayout = "2006-01-02"
+
+// splitFrontMatter separates a leading YAML block delimited by "---" lines
+// from the rest of the file. It returns the file unchanged when there is no
+// front matter.
+func splitFrontMatter(content string) (front string, rest string) {
+	s := strings.TrimPrefix(content, "\ufeff")
+	if !strings.HasPrefix(s, "---\n") && !strings.HasPrefix(s, "---\r\n") {
+		return "", content
+	}
+	s = s[strings.Index(s, "\n")+1:]
+
+	for offset := 0; offset < len(s); {
+		end := strings.Index(s[offset:], "\n")
+		line := s[offset:]
+		if end >= 0 {
+			line = s[offset : offset+end]
+		}
+		if strings.TrimRight(line, "\r") == "---" {
+			if end < 0 {
+				return s[:offset], ""
+			}
+			return s[:offset], s[offset+end+1:]
+		}
+		if end < 0 {
+			break
+		}
+		offset += end + 1
+	}
+	return "", content
+}
+
+// parseFrontMatter decodes front matter into a flat map of strings. Lists
+// are joined with commas, the way a keywords <meta> tag is written.
+func parseFrontMatter(front string) (fields map[string]string, err error) {
+	var raw map[string]interface{}
+	err = yaml.Unmarshal([]byte(front), &raw)
+	if err != nil {
+		return
+	}
+
+	fields = map[string]string{}
+	for k, v := range raw {
+		switch v := v.(type) {
+		case []interface{}:
+			var parts []string
+			for _, p := range v {
+				parts = append(parts, fmt.Sprint(p))
+			}
+			fields[k] = strings.Join(parts, ", ")
+		case time.Time:
+			fields[k] = v.Format(lastReviewedLayout)
+		case nil:
+		default:
+			fields[k] = fmt.Sprint(v)
+		}
+	}
+	return
+}
+
+// metaTags returns the content of every <meta name> in the page, keyed by
+// lower-cased name. The first tag with a name wins.
+func metaTags(content string) (tags map[string]string, err error) {
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return
+	}
+
+	tags = map[string]string{}
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "meta" && n.Namespace == "" {
+			name := strings.ToLower(strings.TrimSpace(htmlpage.Attr(n, "name")))
+			if _, ok := tags[name]; name != "" && !ok {
+				tags[name] = strings.TrimSpace(htmlpage.Attr(n, "content"))
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return
+}
+
+// extractMetadata builds the metadata for fp from its <meta> tags and any
+// front matter fields, which take precedence. Only the fields named in
+// opts.MetaFields are extracted. Missing opts.MetaRequired fields and
+// malformed values are returned as errors.
+func extractMetadata(fp hb.Fullpage, front map[string]string, opts fullpageOptions) (md *pageMetadata, errs []string, err error) {
+	tags, err := metaTags(fp.Content)
+	if err != nil {
+		return
+	}
+	for k, v := range front {
+		tags[strings.ToLower(k)] = v
+	}
+
+	md = &pageMetadata{ID: fp.ID}
+	for _, field := range opts.MetaFields {
+		val := htmlpage.CollapseSpace(tags[field])
+		if val == "" {
+			continue
+		}
+		switch field {
+		case "description":
+			md.Description = val
+		case "keywords":
+			for _, k := range strings.Split(val, ",") {
+				if k = strings.TrimSpace(k); k != "" {
+					md.Keywords = append(md.Keywords, k)
+				}
+			}
+		case "section":
+			md.Section = val
+		case "last-reviewed":
+			_, perr := time.Parse(lastReviewedLayout, val)
+			if perr != nil {
+				errs = append(errs, fmt.Sprintf("metadata: last-reviewed %q is not a YYYY-MM-DD date", val))
+			}
+			md.LastReviewed = val
+		case "author":
+			md.Author = val
+		default:
+			if md.Extra == nil {
+				md.Extra = map[string]string{}
+			}
+			md.Extra[field] = val
+		}
+	}
+
+	for _, field := range opts.MetaRequired {
+		if htmlpage.CollapseSpace(tags[field]) == "" {
+			errs = append(errs, fmt.Sprintf("metadata: required field %v is missing", field))
+		}
+	}
+	return
+}
+
+// sendMetadata uploads md to the companion metadata table.
+func sendMetadata(ctx context.Context, md *pageMetadata) (err error) {
+	url, err := doGetLoadURL("pagemetadata")
+	if err != nil {
+		return
+	}
+	payload, err := json.Marshal(md)
+	if err != nil {
+		return
+	}
+	return apiUpsert(ctx, url, string(payload))
+}
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestSplitFrontMatter(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		front string
+		rest  string
+	}{
+		{
+			name:  "front matter and body",
+			in:    "---\ntitle: Asthma\nauthor: A. Author\n---\n<h1>Asthma</h1>\n",
+			front: "title: Asthma\nauthor: A. Author\n",
+			rest:  "<h1>Asthma</h1>\n",
+		},
+		{
+			name:  "CRLF line endings",
+			in:    "---\r\ntitle: Asthma\r\n---\r\n<h1>Asthma</h1>\r\n",
+			front: "title: Asthma\r\n",
+			rest:  "<h1>Asthma</h1>\r\n",
+		},
+		{
+			name:  "byte order mark",
+			in:    "\ufeff---\ntitle: Asthma\n---\nbody",
+			front: "title: Asthma\n",
+			rest:  "body",
+		},
+		{
+			name:  "closing delimiter at end of file",
+			in:    "---\ntitle: Asthma\n---",
+			front: "title: Asthma\n",
+			rest:  "",
+		},
+		{
+			name:  "empty front matter",
+			in:    "---\n---\nbody",
+			front: "",
+			rest:  "body",
+		},
+		{
+			name:  "no front matter",
+			in:    "<h1>Asthma</h1>\n---\n",
+			front: "",
+			rest:  "<h1>Asthma</h1>\n---\n",
+		},
+		{
+			name:  "unclosed front matter",
+			in:    "---\ntitle: Asthma\n<h1>Asthma</h1>\n",
+			front: "",
+			rest:  "---\ntitle: Asthma\n<h1>Asthma</h1>\n",
+		},
+		{
+			name:  "opening line must be exactly ---",
+			in:    "----\ntitle: Asthma\n---\nbody",
+			front: "",
+			rest:  "----\ntitle: Asthma\n---\nbody",
+		},
+		{
+			name:  "only the first closing delimiter ends it",
+			in:    "---\na: 1\n---\nbody\n---\nmore",
+			front: "a: 1\n",
+			rest:  "body\n---\nmore",
+		},
+		{
+			name:  "delimiter inside a value does not close it",
+			in:    "---\nsummary: a --- b\n---\nbody",
+			front: "summary: a --- b\n",
+			rest:  "body",
+		},
+	}
+	for _, tt := range tests {
+		front, rest := splitFrontMatter(tt.in)
+		if front != tt.front || rest != tt.rest {
+			t.Errorf("%v: splitFrontMatter() = %q, %q; want %q, %q", tt.name, front, rest, tt.front, tt.rest)
+		}
+	}
+}
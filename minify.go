@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// blockElements are the elements around which whitespace-only text does not
+// render, so it can be dropped.
+var blockElements = stringSet([]string{
+	"address", "article", "aside", "base", "blockquote", "body", "caption",
+	"col", "colgroup", "dd", "details", "dialog", "div", "dl", "dt",
+	"fieldset", "figcaption", "figure", "footer", "form", "h1", "h2", "h3",
+	"h4", "h5", "h6", "head", "header", "hr", "html", "li", "link", "main",
+	"meta", "nav", "noscript", "ol", "optgroup", "option", "p", "pre",
+	"script", "section", "style", "summary", "table", "tbody", "td",
+	"tfoot", "th", "thead", "title", "tr", "ul",
+})
+
+// preserveElements keep their whitespace as written.
+var preserveElements = stringSet([]string{"pre", "textarea", "script", "style"})
+
+// pClosers are the start tags that end an open <p>, which makes </p>
+// optional before them.
+var pClosers = stringSet([]string{
+	"address", "article", "aside", "blockquote", "details", "div", "dl",
+	"fieldset", "figcaption", "figure", "footer", "form", "h1", "h2", "h3",
+	"h4", "h5", "h6", "header", "hr", "main", "menu", "nav", "ol", "p",
+	"pre", "section", "table", "ul",
+})
+
+// optionalEnd lists, for each element whose end tag may be omitted, the
+// start tags that may follow it directly. An end tag of the parent may
+// always follow, except the pTransparent ones after </p>.
+var optionalEnd = map[string]map[string]bool{
+	"li":     stringSet([]string{"li"}),
+	"dt":     stringSet([]string{"dt", "dd"}),
+	"dd":     stringSet([]string{"dt", "dd"}),
+	"td":     stringSet([]string{"td", "th"}),
+	"th":     stringSet([]string{"td", "th"}),
+	"tr":     stringSet([]string{"tr"}),
+	"option": stringSet([]string{"option", "optgroup"}),
+	"p":      pClosers,
+}
+
+// pTransparent are the parents whose end tag does not close an open <p>.
+var pTransparent = stringSet([]string{"a", "audio", "del", "ins", "map", "noscript", "video"})
+
+var htmlSpace = regexp.MustCompile(`[ \t\n\r\f]+`)
+
+// minToken is one token of a document being minified.
+type minToken struct {
+	typ  html.TokenType
+	name string
+	text string
+}
+
+// minifyHTML collapses whitespace outside <pre>, <textarea>, <script> and
+// <style>, removes comments other than conditional comments, drops
+// whitespace between block elements and omits optional end tags.
+func minifyHTML(content string) string {
+	z := html.NewTokenizer(strings.NewReader(content))
+
+	var tokens []minToken
+	preserve := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		raw := string(z.Raw())
+
+		switch tt {
+		case html.TextToken:
+			// Text on both sides of a dropped comment is merged, so that
+			// whitespace is collapsed across it.
+			if n := len(tokens); n > 0 && tokens[n-1].typ == html.TextToken {
+				raw = tokens[n-1].text + raw
+				tokens = tokens[:n-1]
+			}
+			if preserve == 0 {
+				raw = htmlSpace.ReplaceAllString(raw, " ")
+			}
+			tokens = append(tokens, minToken{typ: tt, text: raw})
+		case html.CommentToken:
+			if strings.HasPrefix(raw, "<!--[if") || strings.HasPrefix(raw, "<![endif]") {
+				tokens = append(tokens, minToken{typ: tt, text: raw})
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			if tt == html.StartTagToken && preserveElements[t.Data] {
+				preserve++
+			}
+			tokens = append(tokens, minToken{typ: tt, name: t.Data, text: t.String()})
+		case html.EndTagToken:
+			t := z.Token()
+			if preserveElements[t.Data] && preserve > 0 {
+				preserve--
+			}
+			tokens = append(tokens, minToken{typ: tt, name: t.Data, text: t.String()})
+		default:
+			tokens = append(tokens, minToken{typ: tt, text: raw})
+		}
+	}
+
+	// Drop whitespace-only text between two block-level tags.
+	var kept []minToken
+	for i, t := range tokens {
+		if t.typ == html.TextToken && strings.TrimSpace(t.text) == "" {
+			prev := i > 0 && isBlockTag(tokens[i-1])
+			next := i+1 >= len(tokens) || isBlockTag(tokens[i+1])
+			if (i == 0 || prev) && next {
+				continue
+			}
+		}
+		kept = append(kept, t)
+	}
+
+	var b strings.Builder
+	for i, t := range kept {
+		if t.typ == html.EndTagToken && omitEnd(t.name, kept[i+1:]) {
+			continue
+		}
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+func isBlockTag(t minToken) bool {
+	switch t.typ {
+	case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken, html.DoctypeToken:
+		return t.typ == html.DoctypeToken || blockElements[t.name]
+	}
+	return false
+}
+
+// omitEnd reports whether the end tag of name can be left out given the
+// tokens that follow it.
+func omitEnd(name string, rest []minToken) bool {
+	switch name {
+	case "html", "body":
+		for _, t := range rest {
+			if t.typ != html.EndTagToken || (t.name != "html" && t.name != "body") {
+				return false
+			}
+		}
+		return true
+	case "head":
+		return len(rest) > 0 && rest[0].typ != html.TextToken && rest[0].typ != html.CommentToken
+	}
+
+	followers, ok := optionalEnd[name]
+	if !ok {
+		return false
+	}
+	if len(rest) == 0 {
+		return name != "p"
+	}
+	next := rest[0]
+	switch next.typ {
+	case html.StartTagToken, html.SelfClosingTagToken:
+		return followers[next.name]
+	case html.EndTagToken:
+		return name != "p" || !pTransparent[next.name]
+	}
+	return false
+}
+
+// visibleText returns the words a browser would show for content, with a
+// separator at every block boundary and <pre> text kept as written.
+func visibleText(content string) (words []string, err error) {
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return
+	}
+
+	var walk func(n *html.Node, pre bool)
+	walk = func(n *html.Node, pre bool) {
+		switch n.Type {
+		case html.TextNode:
+			if pre {
+				words = append(words, n.Data)
+			} else {
+				words = append(words, strings.Fields(n.Data)...)
+			}
+			return
+		case html.ElementNode:
+			switch n.Data {
+			case "script", "style", "head":
+				return
+			case "pre", "textarea":
+				pre = true
+			}
+			if blockElements[n.Data] {
+				words = append(words, "\x00")
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, pre)
+		}
+	}
+	walk(doc, false)
+
+	// Collapse runs of block separators, which may differ harmlessly.
+	var out []string
+	for _, w := range words {
+		if w == "\x00" && (len(out) == 0 || out[len(out)-1] == "\x00") {
+			continue
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+// minifyPage minifies content. ok is false, and content is returned as
+// authored, when minifying would change the visible text.
+func minifyPage(content string) (minified string, ok bool, err error) {
+	minified = minifyHTML(content)
+
+	before, err := visibleText(content)
+	if err != nil {
+		return
+	}
+	after, err := visibleText(minified)
+	if err != nil {
+		return
+	}
+	if strings.Join(before, "\x01") != strings.Join(after, "\x01") {
+		return content, false, nil
+	}
+	return minified, true, nil
+}
+
+// minifyPages minifies every page of a load, reporting the bytes saved per
+// page and in total on w.
+func minifyPages(items []loadItem, w io.Writer) (err error) {
+	total := 0
+	for i := range items {
+		page := items[i].Page
+		if page == nil {
+			continue
+		}
+
+		minified, ok, err := minifyPage(page.Content)
+		if err != nil {
+			return fmt.Errorf("%v: %v", items[i].Name, err)
+		}
+		if !ok {
+			items[i].Warnings = append(items[i].Warnings, "minify: rendered text would change, kept as authored")
+			continue
+		}
+
+		saved := len(page.Content) - len(minified)
+		pct := 0.0
+		if len(page.Content) > 0 {
+			pct = 100 * float64(saved) / float64(len(page.Content))
+		}
+		fmt.Fprintf(w, "%v: minified %v -> %v bytes, saved %v (%.1f%%)\n", items[i].Name, len(page.Content), len(minified), saved, pct)
+		page.Content = minified
+		total += saved
+	}
+	fmt.Fprintf(w, "minify: saved %v bytes in total\n", total)
+	return
+}
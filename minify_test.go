@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func TestMinifyHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "whitespace runs collapse to one space",
+			in:   "<p>Hello   <b>big</b>\n\n  <i>world</i></p>",
+			want: "<p>Hello <b>big</b> <i>world</i></p>",
+		},
+		{
+			name: "space around inline elements is kept",
+			in:   "<p>a <code>b</code> c</p>",
+			want: "<p>a <code>b</code> c</p>",
+		},
+		{
+			name: "whitespace between blocks is dropped",
+			in:   "<div>\n  <p>a</p>\n  <p>b</p>\n</div>",
+			want: "<div><p>a<p>b</div>",
+		},
+		{
+			name: "pre keeps its whitespace",
+			in:   "<pre>  a\n    b  </pre><p> x  y </p>",
+			want: "<pre>  a\n    b  </pre><p> x y </p>",
+		},
+		{
+			name: "inline elements inside pre keep their whitespace",
+			in:   "<pre><code>if x {\n    y()\n}</code>\n</pre>",
+			want: "<pre><code>if x {\n    y()\n}</code>\n</pre>",
+		},
+		{
+			name: "textarea keeps its whitespace",
+			in:   "<textarea>  a\n b</textarea>",
+			want: "<textarea>  a\n b</textarea>",
+		},
+		{
+			name: "comments are removed, conditional comments kept",
+			in:   "<p>a<!-- note -->  b</p><!--[if IE]><p>ie</p><![endif]-->",
+			want: "<p>a b</p><!--[if IE]><p>ie</p><![endif]-->",
+		},
+		{
+			name: "optional list end tags are omitted",
+			in:   "<ul>\n<li>one</li>\n<li>two</li>\n</ul>",
+			want: "<ul><li>one<li>two</ul>",
+		},
+		{
+			name: "optional table end tags are omitted",
+			in:   "<table><tr><td>1</td><td>2</td></tr><tr><td>3</td></tr></table>",
+			want: "<table><tr><td>1<td>2<tr><td>3</table>",
+		},
+		{
+			name: "p end tag is kept before inline content",
+			in:   "<p>a</p><span>b</span>",
+			want: "<p>a</p><span>b</span>",
+		},
+		{
+			name: "p end tag is kept before the end of a transparent parent",
+			in:   `<a href="x"><p>x</p></a>`,
+			want: `<a href="x"><p>x</p></a>`,
+		},
+		{
+			name: "document end tags are omitted",
+			in:   "<!DOCTYPE html>\n<html>\n<head>\n<title>T</title>\n</head>\n<body>\n<p>x</p>\n</body>\n</html>\n",
+			want: "<!DOCTYPE html><html><head><title>T</title><body><p>x",
+		},
+	}
+	for _, tt := range tests {
+		if got := minifyHTML(tt.in); got != tt.want {
+			t.Errorf("%v:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMinifyPageKeepsText(t *testing.T) {
+	pages := []string{
+		"<p>Hello   <b>big</b>\n\n  <i>world</i></p>",
+		"<pre>  a\n    b  </pre><ul>\n<li>one</li>\n<li>two</li>\n</ul>",
+		"<!DOCTYPE html>\n<html>\n<head>\n<title>T</title>\n</head>\n<body>\n<h1>T</h1>\n<p>a <em>b</em> c</p>\n</body>\n</html>\n",
+	}
+	for _, page := range pages {
+		minified, ok, err := minifyPage(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("minifyPage(%q) changed the visible text", page)
+		}
+		if len(minified) >= len(page) {
+			t.Errorf("minifyPage(%q) = %q, not smaller", page, minified)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"golang.org/x/net/html"
+)
+
+// previewInterval is how often the preview checks its files for changes,
+// and how often the pages it serves ask whether they should reload.
+const previewInterval = time.Second
+
+// previewBook is a book as shown in the preview sidebar.
+type previewBook struct {
+	Title string
+	Pages []string
+}
+
+// previewSite serves the pages of a directory, converted as a load would
+// convert them, rebuilding them whenever a file changes.
+type previewSite struct {
+	dir    string
+	intype string
+	books  string
+	opts   fullpageOptions
+
+	mu      sync.RWMutex
+	pages   map[string]loadItem
+	titles  map[string]string
+	nav     []previewBook
+	assets  map[string]asset
+	err     error
+	version string
+}
+
+// build converts every page and reads the books. Problems are kept for
+// display rather than stopping the server.
+func (s *previewSite) build() {
+	pages := map[string]loadItem{}
+	titles := map[string]string{}
+	assets := map[string]asset{}
+	var nav []previewBook
+
+	items, err := loadDir(s.dir, "fullpage", s.intype, s.opts)
+	for _, item := range items {
+		fp, perr := item.page()
+		if perr != nil {
+			err = perr
+			continue
+		}
+		if fp == nil {
+			continue
+		}
+		item.Page = fp
+		pages[fp.ID] = item
+		titles[fp.ID] = fp.Title
+		for _, a := range item.Assets {
+			assets[a.ID] = a
+		}
+	}
+
+	if err == nil && s.books != "" {
+		nav, err = readPreviewBooks(s.books, titles)
+	}
+	if len(nav) == 0 {
+		all := previewBook{Title: "All pages"}
+		for id := range pages {
+			all.Pages = append(all.Pages, id)
+		}
+		sort.Slice(all.Pages, func(i, j int) bool { return titles[all.Pages[i]] < titles[all.Pages[j]] })
+		nav = []previewBook{all}
+	}
+
+	s.mu.Lock()
+	s.pages, s.titles, s.assets, s.nav, s.err = pages, titles, assets, nav, err
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("preview: %v\n", err)
+	}
+}
+
+// watch rebuilds the site whenever the files under its directories change,
+// until ctx is done.
+func (s *previewSite) watch(ctx context.Context) {
+	last := s.fingerprint()
+	s.mu.Lock()
+	s.version = last
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(previewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fp := s.fingerprint()
+		if fp == last {
+			continue
+		}
+		last = fp
+		log.Println("preview: files changed, rebuilding")
+		s.build()
+		s.mu.Lock()
+		s.version = fp
+		s.mu.Unlock()
+	}
+}
+
+// fingerprint summarises the names, sizes and modification times of the
+// files the site is built from.
+func (s *previewSite) fingerprint() string {
+	h := sha256.New()
+	for _, root := range []string{s.dir, s.books} {
+		if root == "" {
+			continue
+		}
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			fmt.Fprintf(h, "%v %v %v\n", path, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *previewSite) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveIndex)
+	mux.HandleFunc("/page/", s.servePage)
+	mux.HandleFunc("/asset/", s.serveAsset)
+	mux.HandleFunc("/_preview/version", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		io.WriteString(w, s.version)
+	})
+	return mux
+}
+
+// serveIndex redirects to the first page of the first book.
+func (s *previewSite) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, b := range s.nav {
+		if len(b.Pages) > 0 {
+			http.Redirect(w, r, "/page/"+url.PathEscape(b.Pages[0]), http.StatusFound)
+			return
+		}
+	}
+	s.writePage(w, http.StatusOK, "", hb.Fullpage{Title: "No pages", Content: "<p>No pages to preview.</p>"}, nil)
+}
+
+func (s *previewSite) servePage(w http.ResponseWriter, r *http.Request) {
+	id, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/page/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	item, ok := s.pages[id]
+	if !ok {
+		s.writePage(w, http.StatusNotFound, id, hb.Fullpage{Title: "Not found", Content: "<p>No page with ID " + html.EscapeString(id) + ".</p>"}, nil)
+		return
+	}
+	notes := append(append([]string{}, item.Errors...), item.Warnings...)
+	s.writePage(w, http.StatusOK, id, *item.Page, notes)
+}
+
+func (s *previewSite) serveAsset(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	a, ok := s.assets[strings.TrimPrefix(r.URL.Path, "/asset/")]
+	s.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(a.Data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Write(data)
+}
+
+// writePage writes fp with the sidebar, any build problems and the
+// live-reload script added, and its page and asset references pointed at
+// the preview server. The caller holds s.mu.
+func (s *previewSite) writePage(w http.ResponseWriter, status int, current string, fp hb.Fullpage, notes []string) {
+	doc, err := html.Parse(strings.NewReader(fp.Content))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var head, body *html.Node
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "head":
+				head = n
+			case "body":
+				body = n
+			case "style":
+				if n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
+					n.FirstChild.Data = s.previewCSS(n.FirstChild.Data)
+				}
+			}
+			for i, a := range n.Attr {
+				switch {
+				case a.Key == "style":
+					n.Attr[i].Val = s.previewCSS(a.Val)
+				case strings.HasPrefix(a.Val, s.opts.LinkPrefix) && s.opts.LinkPrefix != "":
+					n.Attr[i].Val = "/page/" + previewPageRef(strings.TrimPrefix(a.Val, s.opts.LinkPrefix))
+				case strings.HasPrefix(a.Val, s.opts.AssetPrefix) && s.opts.AssetPrefix != "":
+					n.Attr[i].Val = "/asset/" + strings.TrimPrefix(a.Val, s.opts.AssetPrefix)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	chrome, err := html.ParseFragment(strings.NewReader(s.chrome(current, notes)), body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	first := body.FirstChild
+	for _, n := range chrome {
+		body.InsertBefore(n, first)
+	}
+	style := &html.Node{Type: html.ElementNode, Data: "style"}
+	style.AppendChild(&html.Node{Type: html.TextNode, Data: previewStyle})
+	head.AppendChild(style)
+	script := &html.Node{Type: html.ElementNode, Data: "script"}
+	script.AppendChild(&html.Node{Type: html.TextNode, Data: previewScript})
+	body.AppendChild(script)
+
+	var b bytes.Buffer
+	err = html.Render(&b, doc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+}
+
+// previewCSS points the asset references in css at the preview server.
+func (s *previewSite) previewCSS(css string) string {
+	if s.opts.AssetPrefix == "" {
+		return css
+	}
+	return strings.Replace(css, `url("`+s.opts.AssetPrefix, `url("/asset/`, -1)
+}
+
+// previewPageRef escapes the ID of an "ID#fragment" page reference.
+func previewPageRef(ref string) string {
+	id, frag := ref, ""
+	if i := strings.Index(ref, "#"); i >= 0 {
+		id, frag = ref[:i], ref[i:]
+	}
+	return url.PathEscape(id) + frag
+}
+
+// chrome returns the sidebar and the list of build problems for the page
+// current. The caller holds s.mu.
+func (s *previewSite) chrome(current string, notes []string) string {
+	var b strings.Builder
+	b.WriteString(`<nav id="hb-preview-nav">`)
+	for _, book := range s.nav {
+		b.WriteString("<h2>" + html.EscapeString(book.Title) + "</h2><ul>")
+		for _, id := range book.Pages {
+			class := ""
+			if id == current {
+				class = ` class="current"`
+			}
+			title := s.titles[id]
+			if title == "" {
+				title = id
+			}
+			fmt.Fprintf(&b, `<li%v><a href="/page/%v">%v</a></li>`, class, html.EscapeString(url.PathEscape(id)), html.EscapeString(title))
+		}
+		b.WriteString("</ul>")
+	}
+	b.WriteString("</nav>")
+
+	if s.err != nil {
+		notes = append([]string{s.err.Error()}, notes...)
+	}
+	if len(notes) > 0 {
+		b.WriteString(`<div id="hb-preview-notes"><ul>`)
+		for _, n := range notes {
+			b.WriteString("<li>" + html.EscapeString(n) + "</li>")
+		}
+		b.WriteString("</ul></div>")
+	}
+	return b.String()
+}
+
+const previewStyle = `
+body { margin-left: 18em; }
+#hb-preview-nav { position: fixed; top: 0; left: 0; bottom: 0; width: 16em; overflow: auto; padding: 0 1em; background: #f4f4f4; border-right: 1px solid #ddd; font: 14px sans-serif; }
+#hb-preview-nav h2 { font-size: 1em; margin: 1em 0 0.5em; }
+#hb-preview-nav ul { list-style: none; margin: 0; padding: 0; }
+#hb-preview-nav li { margin: 0.25em 0; }
+#hb-preview-nav li.current a { font-weight: bold; }
+#hb-preview-notes { background: #fff3cd; border: 1px solid #e0c36b; padding: 0.5em 1em; font: 13px sans-serif; }
+`
+
+// previewScript reloads the page when the version reported by the server
+// changes.
+var previewScript = fmt.Sprintf(`
+(function() {
+	var version = null;
+	setInterval(function() {
+		fetch("/_preview/version").then(function(r) { return r.text(); }).then(function(v) {
+			if (version !== null && v !== version) { location.reload(); }
+			version = v;
+		}).catch(function() {});
+	}, %v);
+})();
+`, int64(previewInterval/time.Millisecond))
+
+// readPreviewBooks reads the books at path with readBooks, as check and
+// export do. A book's pages that are not pages of the preview are left out
+// of the sidebar.
+func readPreviewBooks(path string, titles map[string]string) (books []previewBook, err error) {
+	list, err := readBooks(path)
+	if err != nil {
+		return
+	}
+	for _, b := range list {
+		book := previewBook{Title: b.Title}
+		if book.Title == "" {
+			book.Title = b.ID
+		}
+		for _, id := range bookPages(b) {
+			if _, ok := titles[id]; ok {
+				book.Pages = append(book.Pages, id)
+			}
+		}
+		books = append(books, book)
+	}
+	return
+}
+
+// servePreview serves the preview on addr until stop is done.
+func servePreview(stop context.Context, addr string, site *previewSite) (err error) {
+	site.build()
+	go site.watch(stop)
+
+	srv := &http.Server{Addr: addr, Handler: site.handler()}
+	go func() {
+		<-stop.Done()
+		srv.Close()
+	}()
+
+	fmt.Printf("preview: serving %v on http://%v/\n", site.dir, addr)
+	err = srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rstanleyhum/hbctrl/internal/run"
+)
+
+// draftPrefix marks the ID of a draft item. A draft lives in the same table
+// as the live item it will become, so the app never loads it, and publish
+// copies it to the ID without the prefix.
+const draftPrefix = "draft:"
+
+// publishTables are the tables that take drafts, in the order they are
+// published: assets before the pages that show them, and pages before the
+// books and index that refer to them.
+var publishTables = []string{"asset", "fullpage", "pagemetadata", "searchindex", "book"}
+
+func isPublishTable(table string) bool {
+	for _, t := range publishTables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// draftID returns the ID an item is uploaded as.
+func draftID(id string, draft bool) string {
+	if draft {
+		return draftPrefix + id
+	}
+	return id
+}
+
+// draftItems moves the items of a load, and their assets, into the draft
+// namespace. Content is left alone: links between pages, and references to
+// assets, name live IDs, which is what they must name once published.
+func draftItems(items []loadItem) (err error) {
+	for i := range items {
+		item := &items[i]
+		if item.ID != "" {
+			item.ID = draftPrefix + item.ID
+		}
+		if item.Assets != nil {
+			assets := make([]asset, len(item.Assets))
+			for j, a := range item.Assets {
+				a.ID = draftPrefix + a.ID
+				assets[j] = a
+			}
+			item.Assets = assets
+		}
+		if item.Page != nil {
+			fp := *item.Page
+			fp.ID = draftPrefix + fp.ID
+			item.Page = &fp
+		} else if item.JS != "" {
+			var fields map[string]interface{}
+			fields, err = decodeFields(item.JS)
+			if err != nil {
+				return fmt.Errorf("%v: %v", item.Name, err)
+			}
+			id, _ := fields["id"].(string)
+			if id == "" {
+				return fmt.Errorf("%v: no id", item.Name)
+			}
+			fields["id"] = draftPrefix + id
+			var data []byte
+			data, err = json.Marshal(fields)
+			if err != nil {
+				return
+			}
+			item.JS = string(data)
+		}
+		if item.Metadata != nil {
+			md := *item.Metadata
+			md.ID = draftPrefix + md.ID
+			item.Metadata = &md
+		}
+	}
+	return
+}
+
+func decodeFields(js string) (fields map[string]interface{}, err error) {
+	dec := json.NewDecoder(strings.NewReader(js))
+	dec.UseNumber()
+	err = dec.Decode(&fields)
+	return
+}
+
+// cleanPayload returns a server item without the system fields, so it can be
+// sent again, and its ID.
+func cleanPayload(row []byte) (id string, js string, err error) {
+	fields, err := decodeFields(string(row))
+	if err != nil {
+		return
+	}
+	for k := range fields {
+		if systemFields[strings.ToLower(k)] {
+			delete(fields, k)
+		}
+	}
+	id, _ = fields["id"].(string)
+	data, err := json.Marshal(fields)
+	return id, string(data), err
+}
+
+// draftChange is one draft on the server and the live item it replaces.
+type draftChange struct {
+	Table string
+	ID    string
+	// Draft is the draft's payload under the live ID. Live is the live
+	// item's payload, or "" when the draft is a new item.
+	Draft string
+	Live  string
+	// Fields lists the top-level fields that differ from the live item.
+	Fields []string
+}
+
+func (c draftChange) unchanged() bool {
+	return c.Live != "" && len(c.Fields) == 0
+}
+
+// draftChanges fetches the drafts of every publish table and compares each
+// with its live item. A table the server does not have holds no drafts.
+func draftChanges(ctx context.Context) (changes []draftChange, err error) {
+	for _, table := range publishTables {
+		var tableURL string
+		tableURL, err = doGetLoadURL(table)
+		if err != nil {
+			return
+		}
+		var rows []json.RawMessage
+		rows, err = serverRows(ctx, tableURL)
+		if isStatus(err, http.StatusNotFound) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", table, err)
+		}
+
+		live := map[string]string{}
+		var drafts []draftChange
+		for _, r := range rows {
+			var id, js string
+			id, js, err = cleanPayload(r)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", table, err)
+			}
+			if !strings.HasPrefix(id, draftPrefix) {
+				live[id] = js
+				continue
+			}
+			var fields map[string]interface{}
+			fields, err = decodeFields(js)
+			if err != nil {
+				return
+			}
+			fields["id"] = strings.TrimPrefix(id, draftPrefix)
+			var data []byte
+			data, err = json.Marshal(fields)
+			if err != nil {
+				return
+			}
+			drafts = append(drafts, draftChange{Table: table, ID: strings.TrimPrefix(id, draftPrefix), Draft: string(data)})
+		}
+
+		sort.Slice(drafts, func(i, j int) bool { return drafts[i].ID < drafts[j].ID })
+		for _, d := range drafts {
+			d.Live = live[d.ID]
+			if d.Live != "" {
+				d.Fields, err = changedFields(d.Live, d.Draft)
+				if err != nil {
+					return
+				}
+			}
+			changes = append(changes, d)
+		}
+	}
+	return
+}
+
+// changedFields returns the names of the top-level fields of two payloads
+// whose values differ.
+func changedFields(a string, b string) (fields []string, err error) {
+	fa, err := decodeFields(a)
+	if err != nil {
+		return
+	}
+	fb, err := decodeFields(b)
+	if err != nil {
+		return
+	}
+	for k := range fb {
+		if _, ok := fa[k]; !ok {
+			fa[k] = nil
+		}
+	}
+	for k, va := range fa {
+		ja, _ := json.Marshal(va)
+		jb, _ := json.Marshal(fb[k])
+		if string(ja) != string(jb) {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+	return
+}
+
+// printDrafts writes what publishing the drafts would do.
+func printDrafts(w io.Writer, changes []draftChange) {
+	var added, changed, unchanged int
+	for _, c := range changes {
+		switch {
+		case c.Live == "":
+			added++
+			fmt.Fprintf(w, "new:       %v %v\n", c.Table, c.ID)
+		case c.unchanged():
+			unchanged++
+		default:
+			changed++
+			fmt.Fprintf(w, "changed:   %v %v (%v)\n", c.Table, c.ID, strings.Join(c.Fields, ", "))
+		}
+	}
+	fmt.Fprintf(w, "publish: %v new, %v changed, %v unchanged\n", added, changed, unchanged)
+}
+
+// release records one publish: the live payload each published item
+// replaced, per table, or "" for an item that was new. Only items whose
+// write the server confirmed are recorded. Partial is set when the publish
+// stopped part way, leaving the rest of its drafts in place.
+type release struct {
+	Time    string                       `json:"time"`
+	Tables  map[string]map[string]string `json:"tables"`
+	Partial bool                         `json:"partial,omitempty"`
+}
+
+// releaseLog is the history of publishes that rollback works back through.
+type releaseLog struct {
+	Releases []release `json:"releases"`
+}
+
+func readReleaseLog(filename string) (rl releaseLog, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return rl, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &rl)
+	return
+}
+
+func writeReleaseLog(filename string, rl releaseLog) (err error) {
+	data, err := json.MarshalIndent(rl, "", "  ")
+	if err != nil {
+		return
+	}
+	return run.WriteFile(filename, data)
+}
+
+// publishDrafts makes the drafts live and deletes them. The server has no
+// transactions, so the set cannot switch in one request. Instead every
+// draft is fetched and compared before anything is written, and pages go
+// live before the books that list them. A changed item is updated with
+// PATCH and a new one added with POST, and each draft is deleted only once
+// its own write is confirmed, so a failed write leaves the draft to publish
+// again. The release is added to the log when the writes are done, or
+// marked partial when one fails, so that rollback undoes exactly the items
+// that were written.
+func publishDrafts(ctx context.Context, changes []draftChange, logfile string) (err error) {
+	rl, err := readReleaseLog(logfile)
+	if err != nil {
+		return
+	}
+	rel := release{Time: time.Now().UTC().Format(time.RFC3339), Tables: map[string]map[string]string{}}
+	defer func() {
+		if len(rel.Tables) == 0 {
+			return
+		}
+		rel.Partial = err != nil
+		rl.Releases = append(rl.Releases, rel)
+		werr := writeReleaseLog(logfile, rl)
+		if err == nil {
+			err = werr
+		} else if werr != nil {
+			err = fmt.Errorf("%v; release log not written: %v", err, werr)
+		}
+	}()
+
+	for _, c := range changes {
+		var tableURL string
+		tableURL, err = doGetLoadURL(c.Table)
+		if err != nil {
+			return
+		}
+		if !c.unchanged() {
+			if c.Live != "" {
+				err = apiSend(ctx, tableURL+url.PathEscape(c.ID), "PATCH", c.Draft)
+			} else {
+				err = apiUpsert(ctx, tableURL, c.Draft)
+			}
+			if err != nil {
+				return fmt.Errorf("%v %v: %v", c.Table, c.ID, err)
+			}
+			if rel.Tables[c.Table] == nil {
+				rel.Tables[c.Table] = map[string]string{}
+			}
+			rel.Tables[c.Table][c.ID] = c.Live
+		}
+		err = apiSend(ctx, tableURL+url.PathEscape(draftPrefix+c.ID), "DELETE", "")
+		if err != nil {
+			return fmt.Errorf("%v %v: %v", c.Table, draftPrefix+c.ID, err)
+		}
+	}
+	return
+}
+
+// rollbackRelease restores the items of the last release in the log to
+// what they were before it, deleting the items it added, and removes it
+// from the log. Books go back before the pages they list. Restoring an item
+// that is already as it was succeeds, so an interrupted rollback can be run
+// again.
+func rollbackRelease(ctx context.Context, logfile string, w io.Writer) (err error) {
+	rl, err := readReleaseLog(logfile)
+	if err != nil {
+		return
+	}
+	if len(rl.Releases) == 0 {
+		return fmt.Errorf("%v: no release to roll back", logfile)
+	}
+	rel := rl.Releases[len(rl.Releases)-1]
+
+	for i := len(publishTables) - 1; i >= 0; i-- {
+		table := publishTables[i]
+		items := rel.Tables[table]
+		if len(items) == 0 {
+			continue
+		}
+		var tableURL string
+		tableURL, err = doGetLoadURL(table)
+		if err != nil {
+			return
+		}
+		ids := make([]string, 0, len(items))
+		for id := range items {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			itemURL := tableURL + url.PathEscape(id)
+			if previous := items[id]; previous != "" {
+				err = apiSend(ctx, itemURL, "PATCH", previous)
+				if isStatus(err, http.StatusNotFound) {
+					err = apiSend(ctx, tableURL, "POST", previous)
+				}
+				if err != nil {
+					return fmt.Errorf("%v %v: %v", table, id, err)
+				}
+				fmt.Fprintf(w, "restored:  %v %v\n", table, id)
+			} else {
+				err = apiSend(ctx, itemURL, "DELETE", "")
+				if isStatus(err, http.StatusNotFound) {
+					err = nil
+				}
+				if err != nil {
+					return fmt.Errorf("%v %v: %v", table, id, err)
+				}
+				fmt.Fprintf(w, "removed:   %v %v\n", table, id)
+			}
+		}
+	}
+
+	rl.Releases = rl.Releases[:len(rl.Releases)-1]
+	err = writeReleaseLog(logfile, rl)
+	if err != nil {
+		return
+	}
+	state := "release"
+	if rel.Partial {
+		state = "partial release"
+	}
+	fmt.Fprintf(w, "rollback: %v of %v rolled back, %v earlier releases\n", state, rel.Time, len(rl.Releases))
+	return
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChangedFields(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want []string
+	}{
+		{`{"id":"a","title":"T"}`, `{"title":"T","id":"a"}`, nil},
+		{`{"id":"a","title":"T","n":1.0}`, `{"id":"a","title":"U","n":1.0}`, []string{"title"}},
+		{`{"id":"a","tags":["x","y"]}`, `{"id":"a","tags":["y","x"]}`, []string{"tags"}},
+		{`{"id":"a","old":"x"}`, `{"id":"a","new":"x"}`, []string{"new", "old"}},
+		{`{"id":"a","s":null}`, `{"id":"a"}`, nil},
+		{`{"id":"a","o":{"k":1,"j":2}}`, `{"id":"a","o":{"j":2,"k":1}}`, nil},
+	}
+	for _, tt := range tests {
+		got, err := changedFields(tt.a, tt.b)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("changedFields(%v, %v) = %q, %v; want %q", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+
+	if _, err := changedFields(`{"id":`, `{}`); err == nil {
+		t.Errorf("changedFields() of bad JSON returned no error")
+	}
+}
+
+func TestCleanPayload(t *testing.T) {
+	id, js, err := cleanPayload([]byte(`{"id":"draft:a","title":"T","createdAt":"2020-01-01T00:00:00Z","updatedAt":"2020-01-02T00:00:00Z","version":"AAA=","deleted":false}`))
+	if err != nil || id != "draft:a" || js != `{"id":"draft:a","title":"T"}` {
+		t.Errorf("cleanPayload() = %q, %v, %v; want draft:a with id and title only", id, js, err)
+	}
+}
+
+// tableServer serves the rows of each table as a Mobile Apps server does,
+// a page at a time, and 404 for tables it does not have.
+func tableServer(t *testing.T, tables map[string][]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/tables/"), "/")
+		rows, ok := tables[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var top, skip int
+		fmt.Sscan(r.URL.Query().Get("$top"), &top)
+		fmt.Sscan(r.URL.Query().Get("$skip"), &skip)
+		var page []json.RawMessage
+		for i := skip; i < len(rows) && i < skip+top; i++ {
+			page = append(page, json.RawMessage(rows[i]))
+		}
+		err := json.NewEncoder(w).Encode(map[string]interface{}{"results": page, "count": len(rows)})
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func TestDraftChanges(t *testing.T) {
+	srv := tableServer(t, map[string][]string{
+		"fullpageitem": {
+			`{"id":"b","title":"B","content":"old","version":"AAA="}`,
+			`{"id":"draft:b","title":"B","content":"new","version":"AAB="}`,
+			`{"id":"a","title":"A","content":"same"}`,
+			`{"id":"draft:a","title":"A","content":"same","updatedAt":"2020-01-02T00:00:00Z"}`,
+			`{"id":"draft:c","title":"C","content":"added"}`,
+			`{"id":"d","title":"D","content":"live only"}`,
+			`{"id":"draft:e","title":"E","content":"removed","deleted":true}`,
+		},
+		"assetitem": {
+			`{"id":"draft:logo.png","data":"AAAA"}`,
+		},
+		"bookitem": {},
+	})
+	defer srv.Close()
+	defer func(base string, echo bool) { apiBase, echoRequests = base, echo }(apiBase, echoRequests)
+	apiBase, echoRequests = srv.URL+"/", false
+
+	changes, err := draftChanges(context.Background())
+	if err != nil {
+		t.Fatalf("draftChanges() error = %v", err)
+	}
+
+	type change struct {
+		table, id string
+		isNew     bool
+		fields    []string
+	}
+	want := []change{
+		{"asset", "logo.png", true, nil},
+		{"fullpage", "a", false, nil},
+		{"fullpage", "b", false, []string{"content"}},
+		{"fullpage", "c", true, nil},
+	}
+	var got []change
+	for _, c := range changes {
+		got = append(got, change{c.Table, c.ID, c.Live == "", c.Fields})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("draftChanges() = %+v, want %+v", got, want)
+	}
+	if !changes[1].unchanged() || changes[2].unchanged() || changes[3].unchanged() {
+		t.Errorf("unchanged() wrong for a, b or c")
+	}
+	if changes[2].Draft != `{"content":"new","id":"b","title":"B"}` {
+		t.Errorf("draft payload = %v, want the draft under its live ID without system fields", changes[2].Draft)
+	}
+}
+
+func TestDraftChangesServerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	defer func(base string, echo bool) { apiBase, echoRequests = base, echo }(apiBase, echoRequests)
+	apiBase, echoRequests = srv.URL+"/", false
+
+	if _, err := draftChanges(context.Background()); err == nil {
+		t.Errorf("draftChanges() with a failing server returned no error")
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"github.com/rstanleyhum/hbctrl/internal/run"
+)
+
+// pullTables are the tables pull can write back in the form load reads.
+var pullTables = stringSet([]string{"fullpage", "book", "initialupdatejson", "licencekey"})
+
+// pullStateFile records, in the pull directory, the latest updatedAt seen
+// for each table and filter, where an incremental pull starts from, and the
+// IDs whose files that pull keeps. It is hidden, so a load of the directory
+// skips it.
+const pullStateFile = ".hbctrl-pull.json"
+
+type pullState struct {
+	Tables map[string]string `json:"tables"`
+	// IDs lists, by the same key as Tables, the items whose files are in the
+	// directory.
+	IDs map[string][]string `json:"ids,omitempty"`
+}
+
+// pullStateKey returns the key of a pull of table with filter in a
+// pullState. Pulls with different filters fetch different items, so each
+// keeps its own place.
+func pullStateKey(table string, filter string) string {
+	if filter == "" {
+		return table
+	}
+	return table + " " + filter
+}
+
+// pullResult counts what a pull did.
+type pullResult struct {
+	Written, Removed, Skipped int
+	Warnings                  []string
+}
+
+// pull downloads the items of table into dir in the layout a load of the
+// directory reads: <id>.html holding the Content of a Fullpage, and <id>.json
+// holding the item, without the fields the server adds, for other tables.
+//
+// filter is an OData $filter expression. since is "" for every item, "last"
+// to start from the latest change the previous pull of dir with the same
+// table and filter saw, or an RFC 3339 time. An incremental pull removes the
+// files of items deleted since then; a full pull removes the files of the
+// items an earlier pull with the same table and filter wrote that the
+// server no longer returns. Drafts are not pulled.
+func pull(ctx context.Context, dir string, table string, filter string, since string) (res pullResult, err error) {
+	if !pullTables[table] {
+		err = fmt.Errorf("Table %v cannot be pulled", table)
+		return
+	}
+	tableURL, err := doGetLoadURL(table)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	st, err := readPullState(filepath.Join(dir, pullStateFile))
+	if err != nil {
+		return
+	}
+
+	key := pullStateKey(table, filter)
+	if since == "last" {
+		since = st.Tables[key]
+		if since == "" {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("no earlier pull of %v, pulling every item", table))
+		}
+	} else if since != "" {
+		var t time.Time
+		t, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			err = fmt.Errorf("Not a valid time for -since: %v", since)
+			return
+		}
+		since = t.UTC().Format(time.RFC3339Nano)
+	}
+
+	var clauses, params []string
+	if filter != "" {
+		clauses = append(clauses, "("+filter+")")
+	}
+	if since != "" {
+		// ge rather than gt: an item updated in the same instant as the
+		// last one seen is written again rather than missed.
+		clauses = append(clauses, fmt.Sprintf("(updatedAt ge datetimeoffset'%v')", since))
+		params = append(params, "__includeDeleted=true")
+	}
+	if len(clauses) > 0 {
+		params = append(params, "$filter="+url.QueryEscape(strings.Join(clauses, " and ")))
+	}
+	rows, err := serverQuery(ctx, tableURL, strings.Join(params, "&"))
+	if err != nil {
+		return
+	}
+
+	ext := ".json"
+	if table == "fullpage" {
+		ext = ".html"
+	}
+	// kept holds the IDs whose files the directory has after this pull.
+	kept := map[string]bool{}
+	if since != "" {
+		for _, id := range st.IDs[key] {
+			kept[id] = true
+		}
+	}
+
+	latest := st.Tables[key]
+	for _, r := range rows {
+		var row struct {
+			ID        string `json:"id"`
+			UpdatedAt string `json:"updatedAt"`
+			Deleted   bool   `json:"deleted"`
+		}
+		err = json.Unmarshal(r, &row)
+		if err != nil {
+			return
+		}
+		if laterTime(row.UpdatedAt, latest) {
+			latest = row.UpdatedAt
+		}
+		if strings.HasPrefix(row.ID, draftPrefix) {
+			res.Skipped++
+			continue
+		}
+		if !pullFileName(row.ID) {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("%v %q: not usable as a file name, skipped", table, row.ID))
+			res.Skipped++
+			continue
+		}
+
+		filename := filepath.Join(dir, row.ID+ext)
+		if row.Deleted {
+			delete(kept, row.ID)
+			err = os.Remove(filename)
+			if os.IsNotExist(err) {
+				err = nil
+				continue
+			}
+			if err != nil {
+				return
+			}
+			res.Removed++
+			continue
+		}
+
+		var data []byte
+		var warnings []string
+		data, warnings, err = pullFile(table, r)
+		if err != nil {
+			return res, fmt.Errorf("%v %v: %v", table, row.ID, err)
+		}
+		res.Warnings = append(res.Warnings, warnings...)
+		err = ioutil.WriteFile(filename, data, 0644)
+		if err != nil {
+			return
+		}
+		kept[row.ID] = true
+		res.Written++
+	}
+
+	if since == "" {
+		for _, id := range st.IDs[key] {
+			if kept[id] || !pullFileName(id) {
+				continue
+			}
+			err = os.Remove(filepath.Join(dir, id+ext))
+			if os.IsNotExist(err) {
+				err = nil
+				continue
+			}
+			if err != nil {
+				return
+			}
+			res.Removed++
+		}
+	}
+
+	if st.Tables == nil {
+		st.Tables = map[string]string{}
+	}
+	if st.IDs == nil {
+		st.IDs = map[string][]string{}
+	}
+	if latest != "" {
+		st.Tables[key] = latest
+	}
+	ids := make([]string, 0, len(kept))
+	for id := range kept {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	st.IDs[key] = ids
+	err = writePullState(filepath.Join(dir, pullStateFile), st)
+	return
+}
+
+// pullFile returns the file an item is written as. A Fullpage whose title
+// would not be read back from its content is written all the same, with a
+// warning, since changing the content would lose more.
+func pullFile(table string, row []byte) (data []byte, warnings []string, err error) {
+	if table != "fullpage" {
+		var js string
+		_, js, err = cleanPayload(row)
+		if err != nil {
+			return
+		}
+		var fields map[string]interface{}
+		fields, err = decodeFields(js)
+		if err != nil {
+			return
+		}
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(fields)
+		return b.Bytes(), nil, err
+	}
+
+	var fp hb.Fullpage
+	err = json.Unmarshal(row, &fp)
+	if err != nil {
+		return
+	}
+	loaded, _, err := htmlpage.Fullpage(fp.ID, fp.Content, htmlpage.Options{})
+	if err != nil {
+		return
+	}
+	if loaded.Title != fp.Title {
+		warnings = append(warnings, fmt.Sprintf("fullpage %v: title %q will load as %q", fp.ID, fp.Title, loaded.Title))
+	}
+	return []byte(fp.Content), warnings, nil
+}
+
+// pullFileName reports whether id can be a file name that a load maps back
+// to id: no path separators, and not hidden, since loads skip hidden files.
+func pullFileName(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\`) && !strings.HasPrefix(id, ".")
+}
+
+// laterTime reports whether the timestamp a is later than b, which may be
+// empty.
+func laterTime(a string, b string) bool {
+	ta, err := time.Parse(time.RFC3339Nano, a)
+	if err != nil {
+		return false
+	}
+	tb, err := time.Parse(time.RFC3339Nano, b)
+	return err != nil || ta.After(tb)
+}
+
+func readPullState(filename string) (st pullState, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &st)
+	return
+}
+
+// writePullState replaces the state file in one rename, so an interrupted
+// pull leaves the previous state rather than a truncated one.
+func writePullState(filename string, st pullState) (err error) {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return
+	}
+	return run.WriteFile(filename, data)
+}
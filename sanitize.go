@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"golang.org/x/net/html"
+)
+
+// sanitizePolicy is an allowlist of what may appear in Fullpage content.
+// Elements not listed are unwrapped, keeping their children, except those in
+// DropElements which are removed together with their content.
+type sanitizePolicy struct {
+	Elements     []string `json:"elements"`
+	DropElements []string `json:"dropElements"`
+	// Attributes lists the allowed attributes per element. The "*" entry
+	// applies to every element.
+	Attributes map[string][]string `json:"attributes"`
+	// URLSchemes lists the schemes allowed in URL attributes. Relative URLs
+	// are always allowed.
+	URLSchemes []string `json:"urlSchemes"`
+}
+
+// defaultSanitizePolicy allows document structure, text markup, tables,
+// images and links, and removes anything that can run script.
+var defaultSanitizePolicy = sanitizePolicy{
+	Elements: []string{
+		"html", "head", "body", "title", "meta", "link", "style",
+		"article", "aside", "footer", "header", "main", "nav", "section",
+		"h1", "h2", "h3", "h4", "h5", "h6", "p", "div", "span", "br", "hr",
+		"a", "abbr", "b", "blockquote", "cite", "code", "del", "dfn", "em",
+		"i", "ins", "kbd", "mark", "pre", "q", "s", "samp", "small", "strong",
+		"sub", "sup", "time", "u", "var",
+		"dl", "dt", "dd", "ol", "ul", "li",
+		"details", "summary", "figure", "figcaption", "img",
+		"table", "caption", "colgroup", "col", "thead", "tbody", "tfoot", "tr", "th", "td",
+	},
+	DropElements: []string{
+		"script", "noscript", "template", "iframe", "frame", "frameset",
+		"object", "embed", "applet", "svg", "math",
+	},
+	Attributes: map[string][]string{
+		"*":          {"id", "class", "title", "lang", "dir", "style"},
+		"a":          {"href", "name", "target", "rel"},
+		"img":        {"src", "alt", "width", "height"},
+		"meta":       {"name", "content", "charset"},
+		"link":       {"rel", "href", "type", "media"},
+		"style":      {"type", "media"},
+		"ol":         {"start", "type", "reversed"},
+		"li":         {"value"},
+		"td":         {"colspan", "rowspan", "headers"},
+		"th":         {"colspan", "rowspan", "headers", "scope", "abbr"},
+		"col":        {"span"},
+		"colgroup":   {"span"},
+		"time":       {"datetime"},
+		"blockquote": {"cite"},
+		"q":          {"cite"},
+		"del":        {"cite", "datetime"},
+		"ins":        {"cite", "datetime"},
+		"details":    {"open"},
+	},
+	URLSchemes: []string{"http", "https", "mailto", "tel"},
+}
+
+// urlAttributes are the attributes whose values are checked against
+// sanitizePolicy.URLSchemes.
+var urlAttributes = map[string]bool{
+	"href": true, "src": true, "cite": true, "action": true, "formaction": true,
+	"poster": true, "background": true, "longdesc": true, "xlink:href": true,
+}
+
+// readSanitizePolicy reads a policy from a JSON file.
+func readSanitizePolicy(filename string) (policy sanitizePolicy, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &policy)
+	return
+}
+
+// sanitizeHTML applies policy to htmlstring and returns the cleaned document
+// together with a description of every removal.
+func sanitizeHTML(htmlstring string, policy sanitizePolicy) (clean string, removals []string, err error) {
+	doc, err := html.Parse(strings.NewReader(htmlstring))
+	if err != nil {
+		return
+	}
+
+	elements := stringSet(policy.Elements)
+	drop := stringSet(policy.DropElements)
+	schemes := stringSet(policy.URLSchemes)
+	global := stringSet(policy.Attributes["*"])
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			if c.Type != html.ElementNode {
+				walk(c)
+				c = next
+				continue
+			}
+
+			name := c.Data
+			if c.Namespace != "" {
+				name = c.Namespace + ":" + c.Data
+			}
+
+			switch {
+			case drop[c.Data] || drop[name]:
+				removals = append(removals, fmt.Sprintf("<%v> and its content", name))
+				n.RemoveChild(c)
+			case !elements[name]:
+				removals = append(removals, fmt.Sprintf("<%v> tag (content kept)", name))
+				first := c.FirstChild
+				for gc := c.FirstChild; gc != nil; {
+					gnext := gc.NextSibling
+					c.RemoveChild(gc)
+					n.InsertBefore(gc, c)
+					gc = gnext
+				}
+				n.RemoveChild(c)
+				if first != nil {
+					next = first
+				}
+			default:
+				allowed := stringSet(policy.Attributes[name])
+				var attrs []html.Attribute
+				for _, a := range c.Attr {
+					key := a.Key
+					if a.Namespace != "" {
+						key = a.Namespace + ":" + a.Key
+					}
+					if !global[key] && !allowed[key] {
+						removals = append(removals, fmt.Sprintf("%v attribute on <%v>", key, name))
+						continue
+					}
+					if urlAttributes[key] {
+						scheme := urlScheme(a.Val)
+						if scheme != "" && !schemes[scheme] {
+							removals = append(removals, fmt.Sprintf("%v=%q on <%v> (%v: not allowed)", key, a.Val, name, scheme))
+							continue
+						}
+					}
+					attrs = append(attrs, a)
+				}
+				c.Attr = attrs
+				walk(c)
+			}
+			c = next
+		}
+	}
+	walk(doc)
+
+	var b bytes.Buffer
+	err = html.Render(&b, doc)
+	if err != nil {
+		return
+	}
+	clean = b.String()
+	return
+}
+
+// urlScheme returns the lower-cased scheme of a URL attribute value, or ""
+// for a relative URL. Whitespace and control characters are ignored the way
+// browsers ignore them, so "java\tscript:" is still caught.
+func urlScheme(val string) string {
+	var b strings.Builder
+	for _, r := range val {
+		if r <= ' ' {
+			continue
+		}
+		if r == ':' {
+			return strings.ToLower(b.String())
+		}
+		if r == '/' || r == '?' || r == '#' {
+			return ""
+		}
+		b.WriteRune(r)
+	}
+	return ""
+}
+
+func stringSet(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, s := range list {
+		set[s] = true
+	}
+	return set
+}
+
+// sanitizeFullpage runs the sanitiser over fp.Content according to
+// opts.Sanitize. In "report" mode the content is left as authored and the
+// removals are only reported; in "enforce" mode the content is replaced.
+func sanitizeFullpage(fp *hb.Fullpage, opts fullpageOptions) (warnings []string, err error) {
+	switch opts.Sanitize {
+	case "", "off":
+		return
+	case "report", "enforce":
+	default:
+		err = fmt.Errorf("Not a valid sanitize mode: %v", opts.Sanitize)
+		return
+	}
+
+	clean, removals, err := sanitizeHTML(fp.Content, opts.Policy)
+	if err != nil {
+		return
+	}
+
+	verb := "would remove"
+	if opts.Sanitize == "enforce" {
+		verb = "removed"
+		fp.Content = clean
+	}
+	for _, r := range removals {
+		warnings = append(warnings, fmt.Sprintf("sanitize: %v %v", verb, r))
+	}
+	return
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestURLScheme(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"https://example.com/", "https"},
+		{"HTTP://example.com/", "http"},
+		{"mailto:someone@example.com", "mailto"},
+		{"javascript:alert(1)", "javascript"},
+		{"JavaScript:alert(1)", "javascript"},
+		{"  jAvAsCrIpT:alert(1)", "javascript"},
+		{"java\tscript:alert(1)", "javascript"},
+		{"java\nscript:alert(1)", "javascript"},
+		{"\x01javascript:alert(1)", "javascript"},
+		{"data:text/html,<b>", "data"},
+		{"page.html", ""},
+		{"../images/a.png", ""},
+		{"/path/with:colon", ""},
+		{"page.html?q=a:b", ""},
+		{"#section:2", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := urlScheme(tt.in); got != tt.want {
+			t.Errorf("urlScheme(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		want     string
+		removals int
+	}{
+		{
+			name: "allowed markup is kept",
+			in:   `<h1 id="top">Asthma</h1><p class="x">See <a href="https://example.com/" rel="noopener">this</a>.</p>`,
+			want: `<h1 id="top">Asthma</h1><p class="x">See <a href="https://example.com/" rel="noopener">this</a>.</p>`,
+		},
+		{
+			name:     "script is dropped with its content",
+			in:       `<p>a</p><script>alert(1)</script><p>b</p>`,
+			want:     `<p>a</p><p>b</p>`,
+			removals: 1,
+		},
+		{
+			name:     "unknown element is unwrapped",
+			in:       `<p><blink>very <b>important</b></blink></p>`,
+			want:     `<p>very <b>important</b></p>`,
+			removals: 1,
+		},
+		{
+			name:     "nested unknown elements are unwrapped in turn",
+			in:       `<font><center><i>x</i></center></font>`,
+			want:     `<i>x</i>`,
+			removals: 2,
+		},
+		{
+			name:     "event handler attributes are removed",
+			in:       `<p onclick="alert(1)" title="t">x</p><img src="a.png" onerror="alert(1)" alt="a">`,
+			want:     `<p title="t">x</p><img src="a.png" alt="a"/>`,
+			removals: 2,
+		},
+		{
+			name:     "attribute allowed on another element is removed",
+			in:       `<p href="https://example.com/">x</p>`,
+			want:     `<p>x</p>`,
+			removals: 1,
+		},
+		{
+			name:     "javascript: link is removed",
+			in:       `<a href="javascript:alert(1)">x</a>`,
+			want:     `<a>x</a>`,
+			removals: 1,
+		},
+		{
+			name:     "mixed-case scheme is caught",
+			in:       `<a href="JaVaScRiPt:alert(1)">x</a>`,
+			want:     `<a>x</a>`,
+			removals: 1,
+		},
+		{
+			name:     "scheme split by whitespace is caught",
+			in:       "<a href=\"java&#9;script:alert(1)\">x</a><img src=\" javascript:alert(1)\">",
+			want:     `<a>x</a><img/>`,
+			removals: 2,
+		},
+		{
+			name:     "data: image is not an allowed scheme",
+			in:       `<img src="data:image/png;base64,AAAA" alt="a">`,
+			want:     `<img alt="a"/>`,
+			removals: 1,
+		},
+		{
+			name: "relative and allowed schemes are kept",
+			in:   `<a href="other.html#x">a</a><a href="mailto:a@example.com">b</a><a href="TEL:123">c</a>`,
+			want: `<a href="other.html#x">a</a><a href="mailto:a@example.com">b</a><a href="TEL:123">c</a>`,
+		},
+		{
+			name:     "svg is dropped",
+			in:       `<p>x</p><svg><script>alert(1)</script></svg>`,
+			want:     `<p>x</p>`,
+			removals: 1,
+		},
+	}
+	for _, tt := range tests {
+		clean, removals, err := sanitizeHTML(tt.in, defaultSanitizePolicy)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		got := strings.TrimSuffix(strings.TrimPrefix(clean, "<html><head></head><body>"), "</body></html>")
+		if got != tt.want {
+			t.Errorf("%v:\n got %v\nwant %v", tt.name, got, tt.want)
+		}
+		if len(removals) != tt.removals {
+			t.Errorf("%v: %v removals, want %v: %q", tt.name, len(removals), tt.removals, removals)
+		}
+	}
+}
+
+func TestSanitizeHTMLPolicy(t *testing.T) {
+	policy := sanitizePolicy{
+		Elements:   []string{"html", "head", "body", "p", "a"},
+		Attributes: map[string][]string{"a": {"href"}},
+		URLSchemes: []string{"https"},
+	}
+	clean, removals, err := sanitizeHTML(`<p><a href="http://example.com/">a</a><a href="https://example.com/">b</a><em>c</em></p>`, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<p><a>a</a><a href="https://example.com/">b</a>c</p>`
+	if !strings.Contains(clean, want) {
+		t.Errorf("got %v, want it to contain %v", clean, want)
+	}
+	if len(removals) != 2 {
+		t.Errorf("%v removals, want 2: %q", len(removals), removals)
+	}
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"golang.org/x/net/html"
+)
+
+// siteBuilder renders the content of an export as a static website that
+// works from any directory, or straight from the file system, because every
+// link in it is relative.
+type siteBuilder struct {
+	content *exportContent
+	opts    fullpageOptions
+	dir     string
+	lang    string
+	title   string
+	ids     []string
+	// files maps each page ID to its file in the pages directory.
+	files map[string]string
+	// book is the first book listing each page.
+	book     map[string]*bookRecord
+	written  map[string]bool
+	warnings []string
+}
+
+// writeSite writes every book and page of c to dir:
+//
+//	index.html          the books, their chapters and pages, and the pages
+//	                    no book lists
+//	pages/<id>.html     a page, with the navigation of its book
+//	assets/<id>         the images and stylesheets of the pages
+//	search.html         search over search-index.js, the index of the pages
+//	site.css            the site's screen and print styles
+//
+// Links between pages are rewritten to the page files; links to pages that
+// are not in c are removed. Problems that leave the site usable are
+// returned as warnings.
+func writeSite(dir string, c *exportContent, opts fullpageOptions, lang string) (warnings []string, err error) {
+	s := &siteBuilder{
+		content: c,
+		opts:    opts,
+		dir:     dir,
+		lang:    lang,
+		title:   "Handbook",
+		files:   map[string]string{},
+		book:    map[string]*bookRecord{},
+		written: map[string]bool{},
+	}
+	if opts.HandbookType != "" {
+		s.title = humanise(opts.HandbookType)
+	}
+	for id := range c.pages {
+		s.ids = append(s.ids, id)
+	}
+	sort.Strings(s.ids)
+	used := map[string]bool{}
+	for _, id := range s.ids {
+		s.files[id] = siteFile(id, used)
+	}
+	for i := range c.books {
+		for _, id := range bookPages(c.books[i]) {
+			if s.book[id] == nil {
+				s.book[id] = &c.books[i]
+			}
+		}
+	}
+
+	for _, sub := range []string{"pages", "assets"} {
+		err = os.MkdirAll(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			return
+		}
+	}
+	for _, id := range s.ids {
+		var data []byte
+		data, err = s.page(c.pages[id])
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", id, err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, "pages", s.files[id]), data, 0644)
+		if err != nil {
+			return
+		}
+	}
+
+	search, err := s.searchIndex()
+	if err != nil {
+		return
+	}
+	for name, data := range map[string]string{
+		"index.html":      s.index(),
+		"search.html":     s.searchPage(),
+		"search-index.js": search,
+		"search.js":       siteSearchScript,
+		"site.css":        siteStyle,
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			return
+		}
+	}
+	return s.warnings, nil
+}
+
+// siteFile returns the file name of page id: the ID with characters other
+// than letters, digits, "-", "_" and "." replaced, made unique among used.
+func siteFile(id string, used map[string]bool) string {
+	base := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, id)
+	name := base
+	for k := 2; used[strings.ToLower(name)]; k++ {
+		name = fmt.Sprintf("%v-%v", base, k)
+	}
+	used[strings.ToLower(name)] = true
+	return name + ".html"
+}
+
+// page renders fp with the site header, the navigation of its book and
+// links to the pages before and after it.
+func (s *siteBuilder) page(fp hb.Fullpage) (data []byte, err error) {
+	doc, err := html.Parse(strings.NewReader(fp.Content))
+	if err != nil {
+		return
+	}
+
+	var head, body *html.Node
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "html":
+				if htmlpage.Attr(n, "lang") == "" {
+					setAttr(n, "lang", s.lang)
+				}
+			case "head":
+				head = n
+			case "body":
+				body = n
+			case "style":
+				if n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
+					n.FirstChild.Data = s.css(fp.ID, n.FirstChild.Data, "../assets/")
+				}
+			}
+			s.rewriteAttrs(fp.ID, n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	// Pages opened from the file system have no Content-Type to say how
+	// they are encoded.
+	if !hasCharset(head) {
+		meta := &html.Node{Type: html.ElementNode, Data: "meta", Attr: []html.Attribute{{Key: "charset", Val: "utf-8"}}}
+		head.InsertBefore(meta, head.FirstChild)
+	}
+	link := &html.Node{Type: html.ElementNode, Data: "link", Attr: []html.Attribute{{Key: "rel", Val: "stylesheet"}, {Key: "href", Val: "../site.css"}}}
+	head.AppendChild(link)
+	setAttr(body, "class", strings.TrimSpace(htmlpage.Attr(body, "class")+" hb-site-page"))
+
+	before, err := html.ParseFragment(strings.NewReader(s.header("../")+s.nav(fp.ID)), body)
+	if err != nil {
+		return
+	}
+	first := body.FirstChild
+	for _, n := range before {
+		body.InsertBefore(n, first)
+	}
+	after, err := html.ParseFragment(strings.NewReader(s.pager(fp.ID)), body)
+	if err != nil {
+		return
+	}
+	for _, n := range after {
+		body.AppendChild(n)
+	}
+
+	var b bytes.Buffer
+	err = html.Render(&b, doc)
+	return b.Bytes(), err
+}
+
+func hasCharset(head *html.Node) bool {
+	for c := head.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.Data == "meta" && (htmlpage.Attr(c, "charset") != "" || strings.EqualFold(htmlpage.Attr(c, "http-equiv"), "content-type")) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteAttrs points the page and asset references of n at the files of
+// the site.
+func (s *siteBuilder) rewriteAttrs(page string, n *html.Node) {
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		val := strings.TrimSpace(a.Val)
+		switch {
+		case a.Key == "style":
+			a.Val = s.css(page, a.Val, "../assets/")
+		case s.opts.LinkPrefix != "" && strings.HasPrefix(val, s.opts.LinkPrefix):
+			id, frag := splitFragment(strings.TrimPrefix(val, s.opts.LinkPrefix))
+			file, ok := s.files[id]
+			if !ok {
+				s.warnings = append(s.warnings, fmt.Sprintf("%v: link to %v, which is not exported, removed", page, id))
+				continue
+			}
+			a.Val = file + frag
+		case s.opts.AssetPrefix != "" && strings.HasPrefix(val, s.opts.AssetPrefix):
+			id := strings.TrimPrefix(val, s.opts.AssetPrefix)
+			if !s.asset(page, id) {
+				continue
+			}
+			a.Val = "../assets/" + id
+		}
+		attrs = append(attrs, a)
+	}
+	n.Attr = attrs
+}
+
+// css points the asset references in css at the assets directory, which is
+// base from the file the CSS is in.
+func (s *siteBuilder) css(page string, css string, base string) string {
+	if s.opts.AssetPrefix == "" {
+		return css
+	}
+	return cssURL.ReplaceAllStringFunc(css, func(m string) string {
+		ref := cssURL.FindStringSubmatch(m)[2]
+		if !strings.HasPrefix(ref, s.opts.AssetPrefix) {
+			return m
+		}
+		id := strings.TrimPrefix(ref, s.opts.AssetPrefix)
+		if !s.asset(page, id) {
+			return m
+		}
+		return `url("` + base + id + `")`
+	})
+}
+
+// asset writes the asset id to the assets directory, once.
+func (s *siteBuilder) asset(page string, id string) bool {
+	if s.written[id] {
+		return true
+	}
+	a, data, err := s.content.asset(id)
+	if err == nil && strings.ContainsAny(id, `/\`) {
+		err = fmt.Errorf("not a file name")
+	}
+	if err != nil {
+		s.warnings = append(s.warnings, fmt.Sprintf("%v: asset %v: %v", page, id, err))
+		return false
+	}
+	s.written[id] = true
+	if a.ContentType == "text/css" {
+		data = []byte(s.css(page, string(data), ""))
+	}
+	err = ioutil.WriteFile(filepath.Join(s.dir, "assets", id), data, 0644)
+	if err != nil {
+		s.warnings = append(s.warnings, fmt.Sprintf("%v: asset %v: %v", page, id, err))
+		return false
+	}
+	return true
+}
+
+func (s *siteBuilder) pageTitle(id string) string {
+	if title := s.content.pages[id].Title; title != "" {
+		return title
+	}
+	return id
+}
+
+// header returns the site header; root is the path to the top of the site.
+func (s *siteBuilder) header(root string) string {
+	return fmt.Sprintf(`<header id="hb-site-header"><a href="%vindex.html">%v</a><form action="%vsearch.html" role="search"><input type="search" name="q" placeholder="Search" aria-label="Search"></form></header>`,
+		root, html.EscapeString(s.title), root)
+}
+
+// nav returns the navigation of the book listing page current, or nothing
+// for a page in no book.
+func (s *siteBuilder) nav(current string) string {
+	book := s.book[current]
+	if book == nil {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<nav id="hb-site-nav"><h2><a href="../index.html#%v">%v</a></h2>`, html.EscapeString(book.ID), html.EscapeString(book.Title))
+	for _, ch := range book.Chapters {
+		if ch.Title != "" {
+			b.WriteString("<h3>" + html.EscapeString(ch.Title) + "</h3>")
+		}
+		b.WriteString("<ul>")
+		for _, id := range ch.Pages {
+			if _, ok := s.files[id]; !ok {
+				continue
+			}
+			class := ""
+			if id == current {
+				class = ` class="current"`
+			}
+			fmt.Fprintf(&b, `<li%v><a href="%v">%v</a></li>`, class, html.EscapeString(s.files[id]), html.EscapeString(s.pageTitle(id)))
+		}
+		b.WriteString("</ul>")
+	}
+	b.WriteString("</nav>")
+	return b.String()
+}
+
+// pager returns links to the pages before and after current in its book,
+// among those the site holds.
+func (s *siteBuilder) pager(current string) string {
+	book := s.book[current]
+	if book == nil {
+		return ""
+	}
+	var ids []string
+	for _, id := range bookPages(*book) {
+		if _, ok := s.files[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	var b strings.Builder
+	b.WriteString(`<nav id="hb-site-pager">`)
+	for i, id := range ids {
+		if id != current {
+			continue
+		}
+		if i > 0 {
+			fmt.Fprintf(&b, `<a rel="prev" href="%v">&larr; %v</a>`, html.EscapeString(s.files[ids[i-1]]), html.EscapeString(s.pageTitle(ids[i-1])))
+		}
+		if i+1 < len(ids) {
+			fmt.Fprintf(&b, `<a rel="next" href="%v">%v &rarr;</a>`, html.EscapeString(s.files[ids[i+1]]), html.EscapeString(s.pageTitle(ids[i+1])))
+		}
+	}
+	b.WriteString("</nav>")
+	return b.String()
+}
+
+// document wraps body in a page of the site's own, such as the index.
+func (s *siteBuilder) document(title string, body string) string {
+	return fmt.Sprintf("<!DOCTYPE html>\n<html lang=\"%v\"><head><meta charset=\"utf-8\"><meta name=\"viewport\" content=\"width=device-width, initial-scale=1\"><title>%v</title><link rel=\"stylesheet\" href=\"site.css\"></head>\n<body>%v<main>%v</main></body></html>\n",
+		html.EscapeString(s.lang), html.EscapeString(title), s.header(""), body)
+}
+
+// index returns the contents of the site: every book with its chapters and
+// pages, and then the pages that no book lists.
+func (s *siteBuilder) index() string {
+	var b strings.Builder
+	b.WriteString("<h1>" + html.EscapeString(s.title) + "</h1>")
+	item := func(id string) {
+		fmt.Fprintf(&b, `<li><a href="pages/%v">%v</a></li>`, html.EscapeString(s.files[id]), html.EscapeString(s.pageTitle(id)))
+	}
+	for _, book := range s.content.books {
+		fmt.Fprintf(&b, `<section id="%v"><h2>%v</h2>`, html.EscapeString(book.ID), html.EscapeString(book.Title))
+		for _, ch := range book.Chapters {
+			if ch.Title != "" {
+				b.WriteString("<h3>" + html.EscapeString(ch.Title) + "</h3>")
+			}
+			b.WriteString("<ul>")
+			for _, id := range ch.Pages {
+				if _, ok := s.files[id]; ok {
+					item(id)
+				}
+			}
+			b.WriteString("</ul>")
+		}
+		b.WriteString("</section>")
+	}
+
+	var other []string
+	for _, id := range s.ids {
+		if s.book[id] == nil {
+			other = append(other, id)
+		}
+	}
+	if len(other) > 0 {
+		if len(s.content.books) > 0 {
+			b.WriteString(`<section id="hb-other-pages"><h2>Other pages</h2>`)
+		} else {
+			b.WriteString(`<section id="hb-other-pages">`)
+		}
+		sort.SliceStable(other, func(i, j int) bool { return s.pageTitle(other[i]) < s.pageTitle(other[j]) })
+		b.WriteString("<ul>")
+		for _, id := range other {
+			item(id)
+		}
+		b.WriteString("</ul></section>")
+	}
+	return s.document(s.title, b.String())
+}
+
+func (s *siteBuilder) searchPage() string {
+	return s.document("Search: "+s.title, `<h1>Search</h1><ol id="hb-search-results"></ol>`+
+		`<script src="search-index.js"></script><script src="search.js"></script>`)
+}
+
+// searchIndex returns the script that defines the search index of the
+// pages, the file of each page, and the stop words left out of the index.
+// It is a script rather than JSON so that search also works when the site
+// is opened from the file system.
+func (s *siteBuilder) searchIndex() (string, error) {
+	var items []loadItem
+	for _, id := range s.ids {
+		fp := s.content.pages[id]
+		items = append(items, loadItem{ID: id, Page: &fp})
+	}
+	idx, err := buildSearchIndex(items)
+	if err != nil {
+		return "", err
+	}
+	var stop []string
+	for w := range stopWords {
+		stop = append(stop, w)
+	}
+	sort.Strings(stop)
+
+	var b strings.Builder
+	for _, v := range []struct {
+		name  string
+		value interface{}
+	}{{"hbSearchIndex", idx}, {"hbSearchFiles", s.files}, {"hbSearchStop", stop}} {
+		data, err := json.Marshal(v.value)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "var %v = %s;\n", v.name, data)
+	}
+	return b.String(), nil
+}
+
+// siteSearchScript runs the query in the page's ?q= against the index.
+// Query words are not stemmed in the browser. Instead, as the index holds
+// Porter stems, a word matches an index term when the term is a prefix of
+// the word, such as "medic" for "medication", when the word is a prefix of
+// the term, or when the term is one of the word's likely stems, such as
+// "dose" for "dosing". Every word of the query that is not a stop word must
+// match.
+const siteSearchScript = `(function() {
+	var idx = window.hbSearchIndex, files = window.hbSearchFiles, stop = {};
+	window.hbSearchStop.forEach(function(w) { stop[w] = true; });
+
+	function words(q) {
+		return q.toLowerCase().split(/[^\p{L}\p{N}]+/u).filter(function(w) {
+			return w && !stop[w] && (w.length > 1 || /\d/.test(w));
+		});
+	}
+
+	// variants are the word and the likely stems that are not prefixes of
+	// it, such as "dose" for "dosing".
+	function variants(w) {
+		var list = [w, w.replace(/y$/, "i")];
+		var m = /^(.{3,}?)(ing|ed|es|e?s)$/.exec(w);
+		if (m) {
+			list.push(m[1] + "e");
+		}
+		return list;
+	}
+
+	function terms(w) {
+		var found = [], vs = variants(w);
+		for (var t in idx.terms) {
+			var match = w.length >= 3 && t.indexOf(w) === 0;
+			vs.forEach(function(v) {
+				match = match || t === v || (t.length >= 3 && v.indexOf(t) === 0);
+			});
+			if (match) {
+				found.push(t);
+			}
+		}
+		return found;
+	}
+
+	function search(q) {
+		var hits = null;
+		words(q).forEach(function(w) {
+			var found = {};
+			terms(w).forEach(function(t) {
+				var p = idx.terms[t];
+				for (var i = 0; i < p.length; i += 3) {
+					var h = found[p[i]] || (found[p[i]] = {page: p[i], score: 0, sections: {}});
+					h.score += p[i + 2];
+					h.sections[p[i + 1]] = (h.sections[p[i + 1]] || 0) + p[i + 2];
+				}
+			});
+			if (hits === null) {
+				hits = found;
+				return;
+			}
+			for (var k in hits) {
+				if (!found[k]) {
+					delete hits[k];
+					continue;
+				}
+				hits[k].score += found[k].score;
+				for (var s in found[k].sections) {
+					hits[k].sections[s] = (hits[k].sections[s] || 0) + found[k].sections[s];
+				}
+			}
+		});
+		var list = [];
+		for (var k in hits || {}) { list.push(hits[k]); }
+		return list.sort(function(a, b) { return b.score - a.score; });
+	}
+
+	var q = new URLSearchParams(location.search).get("q") || "";
+	var input = document.querySelector("#hb-site-header input");
+	input.value = q;
+	var out = document.getElementById("hb-search-results");
+	var results = search(q);
+	results.forEach(function(h) {
+		var page = idx.pages[h.page], best = 0;
+		for (var s in h.sections) {
+			if (h.sections[s] > (h.sections[best] || 0)) { best = +s; }
+		}
+		var section = page.sections[best] || {};
+		var li = document.createElement("li");
+		var a = document.createElement("a");
+		a.href = "pages/" + files[page.id] + (section.anchor ? "#" + section.anchor : "");
+		a.textContent = page.title + (best > 0 && section.heading ? " › " + section.heading : "");
+		li.appendChild(a);
+		if (page.snippet) {
+			var p = document.createElement("p");
+			p.textContent = page.snippet;
+			li.appendChild(p);
+		}
+		out.appendChild(li);
+	});
+	if (q && !results.length) {
+		out.insertAdjacentHTML("beforebegin", "<p>No pages match.</p>");
+	}
+})();
+`
+
+const siteStyle = `
+body.hb-site-page { margin-left: 18em; }
+#hb-site-header { display: flex; align-items: center; justify-content: space-between; padding: 0.5em 1em; border-bottom: 1px solid #ddd; font: 14px sans-serif; }
+#hb-site-header a { font-weight: bold; text-decoration: none; }
+#hb-site-nav { position: fixed; top: 0; left: 0; bottom: 0; width: 16em; overflow: auto; padding: 0 1em; background: #f4f4f4; border-right: 1px solid #ddd; font: 14px sans-serif; }
+#hb-site-nav h2 { font-size: 1em; margin: 1em 0 0.5em; }
+#hb-site-nav h3 { font-size: 0.9em; margin: 1em 0 0.25em; color: #555; }
+#hb-site-nav ul { list-style: none; margin: 0; padding: 0; }
+#hb-site-nav li { margin: 0.25em 0; }
+#hb-site-nav li.current a { font-weight: bold; }
+#hb-site-pager { display: flex; justify-content: space-between; margin: 2em 0; padding: 1em 0; border-top: 1px solid #ddd; font: 14px sans-serif; }
+#hb-search-results p { margin: 0.25em 0 1em; color: #555; }
+main { max-width: 50em; margin: 0 auto; padding: 0 1em; }
+
+@media (max-width: 50em) {
+	body.hb-site-page { margin-left: 0; }
+	#hb-site-nav { position: static; width: auto; border-right: 0; border-bottom: 1px solid #ddd; }
+}
+
+@media print {
+	body.hb-site-page { margin-left: 0; }
+	#hb-site-header, #hb-site-nav, #hb-site-pager, nav.hb-toc { display: none; }
+	body { font-size: 11pt; color: #000; background: none; }
+	a { color: inherit; text-decoration: none; }
+	a[href^="http"]::after { content: " (" attr(href) ")"; font-size: 90%; }
+	h1, h2, h3, h4, h5, h6 { page-break-after: avoid; }
+	img, table, pre, blockquote { page-break-inside: avoid; }
+	img { max-width: 100%; }
+}
+`
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"github.com/rstanleyhum/hbctrl/internal/itemid"
+	"golang.org/x/net/html"
+)
+
+// splitLevels are the headings a document is split at, per split mode.
+var splitLevels = map[string]map[string]bool{
+	"h1": stringSet([]string{"h1"}),
+	"h2": stringSet([]string{"h1", "h2"}),
+}
+
+// splitPages replaces every page that has more than one heading at the
+// opts.Split level with one page per heading. The first piece keeps the
+// page's ID and name; the others get the ID and name suffixed with the slug
+// of their heading. Each piece keeps the original <head>, so styles still
+// apply, and takes its title from its heading. Fragment links to anchors
+// that have moved to another piece are rewritten to opts.LinkPrefix + that
+// piece's ID.
+func splitPages(items []loadItem, opts fullpageOptions) (out []loadItem, err error) {
+	levels, ok := splitLevels[opts.Split]
+	switch {
+	case opts.Split == "" || opts.Split == "off":
+		return items, nil
+	case !ok:
+		return nil, fmt.Errorf("Not a valid split mode: %v", opts.Split)
+	}
+
+	for _, item := range items {
+		if item.Page == nil {
+			out = append(out, item)
+			continue
+		}
+		var pieces []loadItem
+		pieces, err = splitPage(item, levels, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", item.Name, err)
+		}
+		out = append(out, pieces...)
+	}
+	return
+}
+
+// pagePiece is one part of a page being split.
+type pagePiece struct {
+	fp    hb.Fullpage
+	nodes []*html.Node
+	doc   *html.Node
+}
+
+func splitPage(item loadItem, levels map[string]bool, opts fullpageOptions) (items []loadItem, err error) {
+	doc, err := html.Parse(strings.NewReader(item.Page.Content))
+	if err != nil {
+		return
+	}
+	container := splitContainer(doc)
+	if container == nil {
+		return []loadItem{item}, nil
+	}
+
+	// Gather the children of the container into pieces, starting a new
+	// piece at every heading of a split level. Content before the first
+	// heading stays with the page's own title.
+	pieces := []*pagePiece{{fp: hb.Fullpage{ID: item.Page.ID, Title: item.Page.Title}}}
+	used := map[string]bool{item.Page.ID: true}
+	for c := container.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && levels[c.Data] && c.Namespace == "" {
+			title := htmlpage.CollapseSpace(htmlpage.NodeText(c))
+			cur := pieces[len(pieces)-1]
+			if len(cur.nodes) == 0 || (len(pieces) == 1 && blankNodes(cur.nodes)) {
+				// The heading opens the current piece.
+				cur.fp.Title = title
+			} else {
+				cur = &pagePiece{fp: hb.Fullpage{ID: pieceID(item.Page.ID, title, len(pieces)+1, used), Title: title}}
+				pieces = append(pieces, cur)
+			}
+		}
+		cur := pieces[len(pieces)-1]
+		cur.nodes = append(cur.nodes, c)
+	}
+	if len(pieces) == 1 {
+		return []loadItem{item}, nil
+	}
+
+	for _, p := range pieces {
+		p.doc = pieceDocument(doc, container, p.nodes, p.fp.Title)
+	}
+
+	// Point fragment links at the piece that now holds the anchor.
+	owner := map[string]string{}
+	for _, p := range pieces {
+		for a := range pageAnchors(p.doc) {
+			if _, ok := owner[a]; !ok {
+				owner[a] = p.fp.ID
+			}
+		}
+	}
+	for _, p := range pieces {
+		rewriteFragmentLinks(p.doc, p.fp.ID, owner, opts.LinkPrefix)
+
+		var b bytes.Buffer
+		err = html.Render(&b, p.doc)
+		if err != nil {
+			return
+		}
+		p.fp.Content = b.String()
+	}
+
+	for i, p := range pieces {
+		piece := item
+		fp := p.fp
+		piece.Page = &fp
+		piece.ID = fp.ID
+		piece.Source = item.source()
+		if i > 0 {
+			piece.Name = item.Name + "#" + strings.TrimPrefix(fp.ID, item.Page.ID+"-")
+			piece.Warnings = nil
+			piece.Errors = nil
+		}
+		if item.Metadata != nil {
+			md := *item.Metadata
+			md.ID = fp.ID
+			piece.Metadata = &md
+		}
+		items = append(items, piece)
+	}
+	items[0].Warnings = append(items[0].Warnings, fmt.Sprintf("split: %v pieces", len(pieces)))
+	return
+}
+
+// splitContainer returns the element whose children are split: the body,
+// or the single element wrapping all of its content, such as a <main> or
+// <article>.
+func splitContainer(doc *html.Node) *html.Node {
+	var body *html.Node
+	var find func(*html.Node)
+	find = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "body" {
+			body = n
+			return
+		}
+		for c := n.FirstChild; c != nil && body == nil; c = c.NextSibling {
+			find(c)
+		}
+	}
+	find(doc)
+
+	container := body
+	for container != nil {
+		var only *html.Node
+		count := 0
+		for c := container.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode {
+				only = c
+				count++
+			} else if c.Type == html.TextNode && strings.TrimSpace(c.Data) != "" {
+				count = 2
+			}
+		}
+		if count != 1 || headingElements[only.Data] {
+			break
+		}
+		container = only
+	}
+	return container
+}
+
+// blankNodes reports whether nodes render nothing: whitespace and comments.
+func blankNodes(nodes []*html.Node) bool {
+	for _, n := range nodes {
+		switch {
+		case n.Type == html.CommentNode:
+		case n.Type == html.TextNode && strings.TrimSpace(n.Data) == "":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// pieceID derives the ID of a piece from the page ID and the slug of its
+// heading, or its position when the heading has no usable text.
+func pieceID(base string, title string, n int, used map[string]bool) string {
+	suffix := itemid.Slugify(title)
+	if suffix == "" {
+		suffix = fmt.Sprint(n)
+	}
+	id := base + "-" + suffix
+	for i := 2; used[id]; i++ {
+		id = fmt.Sprintf("%v-%v-%v", base, suffix, i)
+	}
+	used[id] = true
+	return id
+}
+
+// pieceDocument builds a document with doc's <head> and the elements
+// enclosing container, holding nodes. The nodes are moved, not copied.
+func pieceDocument(doc *html.Node, container *html.Node, nodes []*html.Node, title string) *html.Node {
+	var chain []*html.Node
+	for n := container; n != nil && n.Type != html.DocumentNode; n = n.Parent {
+		chain = append([]*html.Node{n}, chain...)
+	}
+
+	out := &html.Node{Type: html.DocumentNode}
+	for c := doc.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.DoctypeNode {
+			out.AppendChild(cloneNode(c, false))
+		}
+	}
+
+	parent := out
+	for _, n := range chain {
+		clone := cloneNode(n, false)
+		parent.AppendChild(clone)
+		if n.Data == "html" {
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type == html.ElementNode && c.Data == "head" {
+					head := cloneNode(c, true)
+					setTitle(head, title)
+					clone.AppendChild(head)
+				}
+			}
+		}
+		parent = clone
+	}
+
+	for _, n := range nodes {
+		if n.Parent != nil {
+			n.Parent.RemoveChild(n)
+		}
+		parent.AppendChild(n)
+	}
+	return out
+}
+
+// cloneNode copies n, and its descendants when deep is set.
+func cloneNode(n *html.Node, deep bool) *html.Node {
+	clone := &html.Node{
+		Type:      n.Type,
+		DataAtom:  n.DataAtom,
+		Data:      n.Data,
+		Namespace: n.Namespace,
+		Attr:      append([]html.Attribute(nil), n.Attr...),
+	}
+	if deep {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			clone.AppendChild(cloneNode(c, true))
+		}
+	}
+	return clone
+}
+
+// setTitle replaces the text of the <title> in head, adding one if needed.
+func setTitle(head *html.Node, title string) {
+	var t *html.Node
+	for c := head.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.Data == "title" {
+			t = c
+			break
+		}
+	}
+	if t == nil {
+		t = &html.Node{Type: html.ElementNode, Data: "title"}
+		head.AppendChild(t)
+	}
+	for t.FirstChild != nil {
+		t.RemoveChild(t.FirstChild)
+	}
+	t.AppendChild(&html.Node{Type: html.TextNode, Data: title})
+}
+
+// rewriteFragmentLinks rewrites <a href="#x"> on the piece self to point at
+// the piece that owns anchor x, when that is another piece.
+func rewriteFragmentLinks(doc *html.Node, self string, owner map[string]string, prefix string) {
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "a" && n.Namespace == "" {
+			href := strings.TrimSpace(htmlpage.Attr(n, "href"))
+			if strings.HasPrefix(href, "#") {
+				if id, ok := owner[href[1:]]; ok && id != self {
+					setAttr(n, "href", prefix+id+href)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	hb "github.com/rstanleyhum/handbookappdb"
+)
+
+const splitDoc = `<!DOCTYPE html><html><head><title>Croup</title><style>p{}</style></head>
+<body><main>
+<h1>Croup</h1><p>Intro <a href="#steroids">steroids</a></p>
+<h2>Signs</h2><p>Barking cough</p>
+<h2 id="steroids">Treatment</h2><p>Dexamethasone <a href="#top">top</a></p>
+<h2>Signs</h2><p>Again</p>
+</main></body></html>`
+
+func TestSplitPage(t *testing.T) {
+	item := loadItem{Name: "croup.html", ID: "croup", Page: &hb.Fullpage{ID: "croup", Title: "Croup", Content: splitDoc}}
+	items, err := splitPages([]loadItem{item}, fullpageOptions{Split: "h2", LinkPrefix: "hb://"})
+	if err != nil {
+		t.Fatalf("splitPages() error = %v", err)
+	}
+
+	want := []struct {
+		id    string
+		name  string
+		title string
+	}{
+		{"croup", "croup.html", "Croup"},
+		{"croup-signs", "croup.html#signs", "Signs"},
+		{"croup-treatment", "croup.html#treatment", "Treatment"},
+		{"croup-signs-2", "croup.html#signs-2", "Signs"},
+	}
+	if len(items) != len(want) {
+		t.Fatalf("splitPages() = %v pieces, want %v", len(items), len(want))
+	}
+	for i, w := range want {
+		p := items[i]
+		if p.ID != w.id || p.Page.ID != w.id || p.Name != w.name || p.Page.Title != w.title || p.source() != "croup.html" {
+			t.Errorf("piece %v = %q %q %q from %q, want %q %q %q", i, p.Page.ID, p.Name, p.Page.Title, p.source(), w.id, w.name, w.title)
+		}
+		if !strings.Contains(p.Page.Content, "<title>"+w.title+"</title>") || !strings.Contains(p.Page.Content, "<style>") {
+			t.Errorf("piece %v does not keep the head with its own title: %v", i, p.Page.Content)
+		}
+		if !strings.Contains(p.Page.Content, "<main>") {
+			t.Errorf("piece %v lost its container: %v", i, p.Page.Content)
+		}
+	}
+	if !strings.Contains(items[0].Page.Content, `href="hb://croup-treatment#steroids"`) {
+		t.Errorf("fragment link to another piece not rewritten: %v", items[0].Page.Content)
+	}
+	if !strings.Contains(items[2].Page.Content, `href="#top"`) {
+		t.Errorf("fragment link to an unknown anchor changed: %v", items[2].Page.Content)
+	}
+	if strings.Contains(items[0].Page.Content, "Barking") || !strings.Contains(items[1].Page.Content, "Barking") {
+		t.Errorf("content not moved to its piece")
+	}
+}
+
+func TestSplitPageLevels(t *testing.T) {
+	item := loadItem{Name: "croup.html", Page: &hb.Fullpage{ID: "croup", Title: "Croup", Content: splitDoc}}
+	items, err := splitPages([]loadItem{item}, fullpageOptions{Split: "h1"})
+	if err != nil || len(items) != 1 || items[0].Page.Content != splitDoc {
+		t.Errorf("split at h1 with one h1 = %v pieces, %v; want the page unchanged", len(items), err)
+	}
+
+	items, err = splitPages([]loadItem{item}, fullpageOptions{})
+	if err != nil || len(items) != 1 {
+		t.Errorf("split off = %v pieces, %v; want the page unchanged", len(items), err)
+	}
+
+	if _, err = splitPages([]loadItem{item}, fullpageOptions{Split: "h3"}); err == nil {
+		t.Errorf("split at h3 returned no error")
+	}
+}
+
+func TestPieceID(t *testing.T) {
+	used := map[string]bool{"p": true}
+	tests := []struct {
+		title string
+		n     int
+		want  string
+	}{
+		{"Signs", 2, "p-signs"},
+		{"Signs", 3, "p-signs-2"},
+		{"...", 4, "p-4"},
+		{"Signs", 5, "p-signs-3"},
+	}
+	for _, tt := range tests {
+		if got := pieceID("p", tt.title, tt.n, used); got != tt.want {
+			t.Errorf("pieceID(%q, %v) = %q, want %q", tt.title, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import "testing"
+
+// porterVectors are words and stems from Porter's paper and the reference
+// vocabulary published with the algorithm.
+var porterVectors = []struct {
+	word string
+	stem string
+}{
+	// Step 1a.
+	{"caresses", "caress"},
+	{"ponies", "poni"},
+	{"ties", "ti"},
+	{"caress", "caress"},
+	{"cats", "cat"},
+	// Step 1b.
+	{"feed", "feed"},
+	{"agreed", "agre"},
+	{"plastered", "plaster"},
+	{"bled", "bled"},
+	{"motoring", "motor"},
+	{"sing", "sing"},
+	{"conflated", "conflat"},
+	{"troubled", "troubl"},
+	{"sized", "size"},
+	{"hopping", "hop"},
+	{"tanned", "tan"},
+	{"falling", "fall"},
+	{"hissing", "hiss"},
+	{"fizzed", "fizz"},
+	{"failing", "fail"},
+	{"filing", "file"},
+	// Step 1c.
+	{"happy", "happi"},
+	{"sky", "sky"},
+	// Step 2.
+	{"relational", "relat"},
+	{"conditional", "condit"},
+	{"rational", "ration"},
+	{"valenci", "valenc"},
+	{"hesitanci", "hesit"},
+	{"digitizer", "digit"},
+	{"conformabli", "conform"},
+	{"radicalli", "radic"},
+	{"differentli", "differ"},
+	{"vileli", "vile"},
+	{"analogousli", "analog"},
+	{"vietnamization", "vietnam"},
+	{"predication", "predic"},
+	{"operator", "oper"},
+	{"feudalism", "feudal"},
+	{"decisiveness", "decis"},
+	{"hopefulness", "hope"},
+	{"callousness", "callous"},
+	{"formaliti", "formal"},
+	{"sensitiviti", "sensit"},
+	{"sensibiliti", "sensibl"},
+	// Step 3.
+	{"triplicate", "triplic"},
+	{"formative", "form"},
+	{"formalize", "formal"},
+	{"electriciti", "electr"},
+	{"electrical", "electr"},
+	{"hopeful", "hope"},
+	{"goodness", "good"},
+	// Step 4.
+	{"revival", "reviv"},
+	{"allowance", "allow"},
+	{"inference", "infer"},
+	{"airliner", "airlin"},
+	{"gyroscopic", "gyroscop"},
+	{"adjustable", "adjust"},
+	{"defensible", "defens"},
+	{"irritant", "irrit"},
+	{"replacement", "replac"},
+	{"adjustment", "adjust"},
+	{"dependent", "depend"},
+	{"adoption", "adopt"},
+	{"homologou", "homolog"},
+	{"communism", "commun"},
+	{"activate", "activ"},
+	{"angulariti", "angular"},
+	{"homologous", "homolog"},
+	{"effective", "effect"},
+	{"bowdlerize", "bowdler"},
+	// Step 5.
+	{"probate", "probat"},
+	{"rate", "rate"},
+	{"cease", "ceas"},
+	{"controll", "control"},
+	{"roll", "roll"},
+	// Several steps.
+	{"generalizations", "gener"},
+	{"oscillators", "oscil"},
+	{"dosing", "dose"},
+	{"medications", "medic"},
+}
+
+func TestPorterStem(t *testing.T) {
+	for _, v := range porterVectors {
+		if got := porterStem(v.word); got != v.stem {
+			t.Errorf("porterStem(%q) = %q, want %q", v.word, got, v.stem)
+		}
+	}
+}
+
+func TestPorterStemLeavesOtherWords(t *testing.T) {
+	for _, w := range []string{"a", "is", "as", "mg", "covid19", "fièvre", "Asthma", ""} {
+		if got := porterStem(w); got != w {
+			t.Errorf("porterStem(%q) = %q, want it unchanged", w, got)
+		}
+	}
+}
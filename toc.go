@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rstanleyhum/hbctrl/internal/htmlpage"
+	"github.com/rstanleyhum/hbctrl/internal/itemid"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// tocClass marks the contents list embedded in a page, so that a page
+// loaded again gets its list replaced rather than a second one.
+const tocClass = "hb-toc"
+
+// tocEntry is one heading of a page and the headings below it.
+type tocEntry struct {
+	Title    string     `json:"title" yaml:"title"`
+	Anchor   string     `json:"anchor,omitempty" yaml:"anchor,omitempty"`
+	Children []tocEntry `json:"children,omitempty" yaml:"children,omitempty"`
+}
+
+// tocPage is the contents of one page of a book.
+type tocPage struct {
+	ID       string     `json:"id" yaml:"id"`
+	Title    string     `json:"title" yaml:"title"`
+	Sections []tocEntry `json:"sections,omitempty" yaml:"sections,omitempty"`
+}
+
+// headingPages runs the opts.Headings pass over the Fullpages of a load:
+// "anchor" gives every heading without an anchor a stable id made from its
+// text, and "toc" also embeds the page's contents after its first <h1>, or at
+// the top of the body when it has none. Pages loaded from JSON are sent as
+// they are and left alone.
+func headingPages(items []loadItem, opts fullpageOptions) (err error) {
+	switch opts.Headings {
+	case "", "off":
+		return
+	case "anchor", "toc":
+	default:
+		return fmt.Errorf("Not a valid headings mode: %v", opts.Headings)
+	}
+
+	for i := range items {
+		fp := items[i].Page
+		if fp == nil {
+			continue
+		}
+		var doc *html.Node
+		doc, err = html.Parse(strings.NewReader(fp.Content))
+		if err != nil {
+			return fmt.Errorf("%v: %v", items[i].Name, err)
+		}
+		removeTOC(doc)
+		added := anchorHeadings(doc)
+		if opts.Headings == "toc" {
+			embedTOC(doc, pageTOC(doc))
+		} else if added == 0 {
+			continue
+		}
+
+		var b bytes.Buffer
+		err = html.Render(&b, doc)
+		if err != nil {
+			return fmt.Errorf("%v: %v", items[i].Name, err)
+		}
+		fp.Content = b.String()
+		if added > 0 {
+			items[i].Warnings = append(items[i].Warnings, fmt.Sprintf("headings: %v anchors added", added))
+		}
+	}
+	return
+}
+
+// anchorHeadings sets an id on every heading that has no anchor, taken from
+// the slug of its text and made unique within the document, and returns how
+// many it set.
+func anchorHeadings(doc *html.Node) (added int) {
+	used := pageAnchors(doc)
+	eachHeading(doc, func(n *html.Node) {
+		if headingAnchor(n) != "" {
+			return
+		}
+		base := itemid.Slugify(htmlpage.NodeText(n))
+		if base == "" {
+			base = "section"
+		}
+		id := base
+		for k := 2; used[id]; k++ {
+			id = base + "-" + strconv.Itoa(k)
+		}
+		used[id] = true
+		setAttr(n, "id", id)
+		added++
+	})
+	return
+}
+
+// pageTOC returns the headings of doc nested by level. A heading nests under
+// the closest heading before it of a higher level, so skipped levels do not
+// leave empty entries. When the page has a single top-level heading, its
+// title heading, the contents are the headings under it.
+func pageTOC(doc *html.Node) []tocEntry {
+	type open struct {
+		level int
+		entry *tocEntry
+	}
+	var root tocEntry
+	stack := []open{{0, &root}}
+	eachHeading(doc, func(n *html.Node) {
+		level := int(n.Data[1] - '0')
+		for stack[len(stack)-1].level >= level {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1].entry
+		parent.Children = append(parent.Children, tocEntry{Title: htmlpage.CollapseSpace(htmlpage.NodeText(n)), Anchor: headingAnchor(n)})
+		stack = append(stack, open{level, &parent.Children[len(parent.Children)-1]})
+	})
+	if len(root.Children) == 1 {
+		return root.Children[0].Children
+	}
+	return root.Children
+}
+
+// eachHeading calls fn for every heading of doc in document order, skipping
+// an embedded contents list.
+func eachHeading(doc *html.Node, fn func(*html.Node)) {
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Namespace == "" {
+			switch {
+			case n.Data == "head" || isTOC(n):
+				return
+			case headingElements[n.Data]:
+				fn(n)
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+}
+
+// embedTOC inserts entries as a <nav> of nested lists after the first <h1>
+// of doc, or at the top of its body. Contents with fewer than two entries are
+// not worth a list and are left out.
+func embedTOC(doc *html.Node, entries []tocEntry) {
+	if len(entries) < 2 {
+		return
+	}
+	nav := &html.Node{Type: html.ElementNode, Data: "nav", DataAtom: atom.Nav, Attr: []html.Attribute{
+		{Key: "class", Val: tocClass},
+		{Key: "aria-label", Val: "Contents"},
+	}}
+	nav.AppendChild(tocList(entries))
+
+	var h1, body *html.Node
+	var find func(*html.Node)
+	find = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Namespace == "" {
+			switch {
+			case n.Data == "body" && body == nil:
+				body = n
+			case n.Data == "h1" && h1 == nil:
+				h1 = n
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil && h1 == nil; c = c.NextSibling {
+			find(c)
+		}
+	}
+	find(doc)
+
+	switch {
+	case h1 != nil:
+		h1.Parent.InsertBefore(nav, h1.NextSibling)
+	case body != nil:
+		body.InsertBefore(nav, body.FirstChild)
+	}
+}
+
+func tocList(entries []tocEntry) *html.Node {
+	ol := &html.Node{Type: html.ElementNode, Data: "ol", DataAtom: atom.Ol}
+	for _, e := range entries {
+		li := &html.Node{Type: html.ElementNode, Data: "li", DataAtom: atom.Li}
+		text := &html.Node{Type: html.TextNode, Data: e.Title}
+		if e.Anchor != "" {
+			a := &html.Node{Type: html.ElementNode, Data: "a", DataAtom: atom.A, Attr: []html.Attribute{{Key: "href", Val: "#" + e.Anchor}}}
+			a.AppendChild(text)
+			li.AppendChild(a)
+		} else {
+			li.AppendChild(text)
+		}
+		if len(e.Children) > 0 {
+			li.AppendChild(tocList(e.Children))
+		}
+		ol.AppendChild(li)
+	}
+	return ol
+}
+
+func isTOC(n *html.Node) bool {
+	return n.Data == "nav" && hasToken(htmlpage.Attr(n, "class"), tocClass)
+}
+
+// removeTOC removes a contents list embedded by an earlier load.
+func removeTOC(doc *html.Node) {
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			if c.Type == html.ElementNode && isTOC(c) {
+				n.RemoveChild(c)
+			} else {
+				walk(c)
+			}
+			c = next
+		}
+	}
+	walk(doc)
+}
+
+// bookTOC returns the contents of every page of book, in book order, from
+// the pages of a load.
+func bookTOC(book bookRecord, items []loadItem) (contents []tocPage, err error) {
+	pages := map[string]loadItem{}
+	for _, item := range items {
+		pages[item.ID] = item
+	}
+	for _, ch := range book.Chapters {
+		for _, id := range ch.Pages {
+			item, ok := pages[id]
+			if !ok {
+				continue
+			}
+			fp, err := item.page()
+			if err != nil {
+				return nil, err
+			}
+			if fp == nil {
+				continue
+			}
+			doc, err := html.Parse(strings.NewReader(fp.Content))
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", item.Name, err)
+			}
+			contents = append(contents, tocPage{ID: fp.ID, Title: fp.Title, Sections: pageTOC(doc)})
+		}
+	}
+	return
+}